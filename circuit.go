@@ -5,9 +5,9 @@
 package main
 
 import (
-	"github.com/tvdw/gotor/aes"
-	"github.com/tvdw/gotor/sha1"
+	"errors"
 	"sync"
+	"time"
 )
 
 type CircuitID uint32
@@ -28,11 +28,6 @@ func (id CircuitID) MSB(vers LinkVersion) bool {
 	}
 }
 
-type DirectionalCircuitState struct {
-	cipher aes.Cipher
-	digest *sha1.Digest
-}
-
 type DataDirection bool
 
 const (
@@ -50,11 +45,32 @@ type Circuit struct {
 
 	streams     map[StreamID]*Stream
 	extendState *CircuitHandshakeState
+
+	created, lastActivity, extendStarted time.Time
+
+	queue *QueueAccount
+	cells *CircuitQueue
+
+	// Authenticated SENDMEs, see sendme.go
+	dataCellsSent int
+	sendmeDigests [][]byte
+
+	// Set if the circuit negotiated congestion control, see congestion.go
+	cc *CongestionControl
+
+	// Set once the circuit is part of a conflux set, see conflux.go
+	conflux *confluxLeg
+
+	// How often we refused a stream because of a limit, see streamlimit.go
+	streamsRefused int
 }
 
 type RelayCircuit struct {
 	id, theirID CircuitID
 	previousHop CircReadQueue
+
+	queue *QueueAccount
+	cells *CircuitQueue
 }
 
 type CircuitHandshakeState struct {
@@ -101,36 +117,28 @@ func (c *CircuitCreated) ReleaseBuffers() {
 	ReturnCellBuf(c.handshakeData)
 }
 
-var zeroIv [16]byte
-
 func NewCircuit(id CircuitID, fSeed, bSeed, fKey, bKey []byte) *Circuit {
+	return newCircuitWithState(id, newTor1CircuitState(fSeed, fKey), newTor1CircuitState(bSeed, bKey))
+}
+
+func newCircuitWithState(id CircuitID, forward, backward DirectionalCircuitState) *Circuit {
 	if id == 0 {
 		panic("wtf?")
 	}
 
 	StatsNewCircuit()
 
-	aes_fwd := aes.New(fKey, zeroIv[:])
-	aes_rev := aes.New(bKey, zeroIv[:])
-
-	dig_fwd := sha1.New()
-	dig_fwd.Write(fSeed)
-	dig_rev := sha1.New()
-	dig_rev.Write(bSeed)
+	now := time.Now()
 
 	circ := &Circuit{
-		id: id,
-		forward: DirectionalCircuitState{
-			cipher: aes_fwd,
-			digest: dig_fwd,
-		},
-		backward: DirectionalCircuitState{
-			cipher: aes_rev,
-			digest: dig_rev,
-		},
-		backwardWindow: NewWindow(1000),
-		forwardWindow:  1000,
+		id:             id,
+		forward:        forward,
+		backward:       backward,
+		backwardWindow: NewWindow(CIRCWINDOW_START),
+		forwardWindow:  CIRCWINDOW_START,
 		streams:        make(map[StreamID]*Stream),
+		created:        now,
+		lastActivity:   now,
 	}
 
 	return circ
@@ -141,10 +149,14 @@ func (c *OnionConnection) destroyCircuit(circ *Circuit, announce, shouldRemove b
 		delete(c.circuits, circ.id)
 	}
 
-	circ.backwardWindow.Abort()
+	if circ.conflux == nil || !c.confluxLegClosed(circ) {
+		circ.backwardWindow.Abort()
+	}
 	for _, stream := range circ.streams {
 		stream.Destroy()
 	}
+	c.scheduler.Detach(circ.cells)
+	circ.queue.Release()
 
 	StatsDestroyCircuit()
 
@@ -172,8 +184,8 @@ func (c *OnionConnection) destroyCircuit(circ *Circuit, announce, shouldRemove b
 
 	// Set things to nil to mitigate possible memory leaks caused by other objects retaining this circuit (which is obviously a bug)
 	circ.nextHop = nil
-	circ.forward = DirectionalCircuitState{}
-	circ.backward = DirectionalCircuitState{}
+	circ.forward = nil
+	circ.backward = nil
 	circ.streams = nil
 	circ.backwardWindow = nil
 }
@@ -181,8 +193,12 @@ func (c *OnionConnection) destroyCircuit(circ *Circuit, announce, shouldRemove b
 func (c *OnionConnection) destroyRelayCircuit(circ *RelayCircuit, announce, shouldRemove bool, reason DestroyReason) {
 	if shouldRemove {
 		delete(c.relayCircuits, circ.id)
+		c.reserveDestroyedCircID(circ.id)
 	}
 
+	c.scheduler.Detach(circ.cells)
+	circ.queue.Release()
+
 	if announce && circ.previousHop != nil {
 		circ.previousHop <- &CircuitDestroyed{
 			id:       circ.theirID,
@@ -193,23 +209,96 @@ func (c *OnionConnection) destroyRelayCircuit(circ *RelayCircuit, announce, shou
 	}
 }
 
-func (c *OnionConnection) NewCircID() CircuitID {
-	for {
-		var b [4]byte
-		CRandBytes(b[:])
-		if c.isOutbound {
-			b[0] |= 0x80
-		} else {
-			b[0] &= 0x7f
+// How long an ID we allocated stays reserved after its circuit was destroyed. Cells for the old circuit
+// may still be in flight, and we don't want them to end up on a new circuit that happens to get the same ID.
+const CIRC_ID_GRACE_PERIOD = 60 * time.Second
+
+func (c *OnionConnection) circIDSpace() (first, count CircuitID) {
+	if c.negotiatedVersion < 4 {
+		first, count = 0x0000, 0x8000
+	} else {
+		first, count = 0x00000000, 0x80000000
+	}
+	if c.isOutbound {
+		first += count
+	}
+	if first == 0 { // CircID 0 is reserved
+		first, count = 1, count-1
+	}
+	return
+}
+
+func (c *OnionConnection) circIDInUse(id CircuitID) bool {
+	if _, exists := c.circuits[id]; exists {
+		return true
+	}
+	if _, exists := c.relayCircuits[id]; exists {
+		return true
+	}
+	if _, exists := c.destroyedCircIDs[id]; exists {
+		return true
+	}
+	if _, exists := c.pendingCreates[id]; exists {
+		return true
+	}
+	return false
+}
+
+func (c *OnionConnection) reserveDestroyedCircID(id CircuitID) {
+	c.destroyedCircIDs[id] = time.Now().Add(CIRC_ID_GRACE_PERIOD)
+}
+
+func (c *OnionConnection) pruneDestroyedCircIDs() {
+	now := time.Now()
+	if now.Before(c.nextCircIDPrune) {
+		return
+	}
+	for id, expires := range c.destroyedCircIDs {
+		if now.After(expires) {
+			delete(c.destroyedCircIDs, id)
 		}
-		cID := CircuitID(BigEndian.Uint32(b[:]))
-		if c.negotiatedVersion < 4 {
-			cID = (cID & 0xffff0000) >> 16 // Cut off the last 16 bits as we can't transmit them
+	}
+	c.nextCircIDPrune = now.Add(CIRC_ID_GRACE_PERIOD / 4)
+}
+
+func (c *OnionConnection) NewCircID() (CircuitID, error) {
+	c.pruneDestroyedCircIDs()
+
+	first, count := c.circIDSpace()
+	used := len(c.circuits) + len(c.relayCircuits) + len(c.destroyedCircIDs) + len(c.pendingCreates)
+	if CircuitID(used) >= count {
+		// The maps also hold IDs from the other half of the space, so this is only a quick check
+		used = 0
+		for id := first; id-first < count; id++ {
+			if c.circIDInUse(id) {
+				used++
+			}
+		}
+		if CircuitID(used) >= count {
+			return 0, errors.New("no circuit IDs left on this connection")
 		}
+	}
 
-		_, exists := c.circuits[cID]
-		if !exists { // XXX check infinite loop
-			return cID
+	// Random IDs are unlikely to collide unless the space is nearly full
+	var b [4]byte
+	for i := 0; i < 64; i++ {
+		CRandBytes(b[:])
+		cID := first + CircuitID(BigEndian.Uint32(b[:]))%count
+		if !c.circIDInUse(cID) {
+			return cID, nil
 		}
 	}
+
+	// Walk the space from a random offset. Every step that fails lands on an ID in use, so this terminates
+	// after at most `used` steps.
+	CRandBytes(b[:])
+	offset := CircuitID(BigEndian.Uint32(b[:])) % count
+	for i := CircuitID(0); i < count; i++ {
+		cID := first + (offset+i)%count
+		if !c.circIDInUse(cID) {
+			return cID, nil
+		}
+	}
+
+	return 0, errors.New("no circuit IDs left on this connection")
 }
@@ -7,6 +7,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 type CircuitCommand interface {
@@ -23,6 +24,11 @@ type NeverForRelay struct {
 type NoBuffers struct {
 }
 
+// Implemented by internal commands that must not be dropped silently when their circuit is gone
+type UndeliverableCommand interface {
+	Undeliverable()
+}
+
 func (c *NeverForRelay) ForRelay() bool {
 	return false
 }
@@ -44,6 +50,7 @@ func (c *OnionConnection) routeCellToFunction(cell Cell) ActionableError {
 		circID := cell.CircID()
 		circ, ok := c.circuits[circID]
 		if ok {
+			circ.lastActivity = time.Now()
 			return c.handleRelayForward(circ, cell)
 		}
 
@@ -95,9 +102,13 @@ func (c *OnionConnection) routeCircuitCommandToFunction(cmd CircuitCommand) Acti
 		circ, ok := c.circuits[circID]
 		if !ok {
 			Log(LOG_INFO, "got internal command for nonexisting circuit %v", cmd)
+			if u, ok := cmd.(UndeliverableCommand); ok {
+				u.Undeliverable()
+			}
 			return nil // It happens, nothing to worry about
 		}
 
+		circ.lastActivity = time.Now()
 		return cmd.Handle(c, circ)
 	} else {
 		if circID == 0 { // Control command
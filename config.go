@@ -9,10 +9,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -21,12 +23,58 @@ type Config struct {
 	DirPort        uint16
 	DataDirectory  string
 
+	// Whether we listen on the DirPort ourselves. Otherwise something else serves it on 127.0.0.1, and directory
+	// requests we can't answer are passed on to it
+	ServeDirPort bool
+
 	// Descriptor related only
 	Contact, Nickname, Platform, Address            string
 	BandwidthAvg, BandwidthBurst, BandwidthObserved int
 	Family                                          []string
 
 	ExitPolicy ExitPolicy
+	IPv6Exit   bool // Whether we connect to IPv6 addresses at all
+
+	// Source addresses for our outgoing connections. The OR and Exit ones take precedence over the general one
+	OutboundBindAddress, OutboundBindAddressOR, OutboundBindAddressExit BindAddresses
+
+	// Circuit timeouts. Zero disables the check
+	CircuitIdleTimeout, CircuitExtendTimeout, MaxCircuitLifetime time.Duration
+
+	// Exit stream timeouts. Zero disables the check
+	StreamConnectTimeout, StreamIdleTimeout time.Duration
+
+	// Limits on concurrent streams, see streamlimit.go. Zero means no limit
+	MaxStreamsPerCircuit, MaxStreamsPerConnection, MaxExitSockets int
+
+	// Whether we publish exit port statistics in our extra-info descriptor
+	ExitPortStatistics bool
+
+	// Versions of authenticated SENDMEs (proposal 289) we send and require
+	SendMeEmitMinVersion, SendMeAcceptMinVersion int
+
+	// Halflife of the EWMA circuit scheduler. Zero disables the decay
+	CircuitPriorityHalflife time.Duration
+
+	// Upper bound on the memory used by queued cells. Zero means no limit
+	MaxMemInQueues int64
+
+	// Handshakes we are willing to do
+	RefuseTAP                 bool
+	CreateFastFromClientsOnly bool
+
+	// Onionskin workers. NumCPUs=0 means one worker per CPU
+	NumCPUs            int
+	MaxOnionQueueDelay time.Duration
+
+	// DoS mitigation, see dos.go
+	DoSCircuitCreationEnabled           bool
+	DoSCircuitCreationMinConnections    int
+	DoSCircuitCreationRate              int // per second
+	DoSCircuitCreationBurst             int
+	DoSCircuitCreationDefenseTimePeriod time.Duration
+	DoSConnectionEnabled                bool
+	DoSConnectionMaxConcurrentCount     int
 }
 
 func (c *Config) ReadFile(filename string) error {
@@ -63,6 +111,13 @@ func (c *Config) ReadFile(filename string) error {
 			}
 			c.ORPort = uint16(port)
 
+		case "dirport":
+			port, err := strconv.ParseUint(matches[2], 0, 16)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+			c.DirPort = uint16(port)
+
 		case "bandwidthrate", "bandwidthburst", "maxadvertisedbandwidth":
 			bw := bandwidthRe.FindStringSubmatch(matches[2])
 			if bw == nil {
@@ -146,6 +201,171 @@ func (c *Config) ReadFile(filename string) error {
 		case "address":
 			c.Address = matches[2]
 
+		case "circuitidletimeout", "circuitextendtimeout", "maxcircuitlifetime":
+			d, err := parseInterval(matches[2])
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+
+			if lower == "circuitidletimeout" {
+				c.CircuitIdleTimeout = d
+			} else if lower == "circuitextendtimeout" {
+				c.CircuitExtendTimeout = d
+			} else if lower == "maxcircuitlifetime" {
+				c.MaxCircuitLifetime = d
+			}
+
+		case "streamconnecttimeout", "streamidletimeout":
+			d, err := parseInterval(matches[2])
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+
+			if lower == "streamconnecttimeout" {
+				c.StreamConnectTimeout = d
+			} else if lower == "streamidletimeout" {
+				c.StreamIdleTimeout = d
+			}
+
+		case "outboundbindaddress", "outboundbindaddressor", "outboundbindaddressexit":
+			var ba *BindAddresses
+			if lower == "outboundbindaddress" {
+				ba = &c.OutboundBindAddress
+			} else if lower == "outboundbindaddressor" {
+				ba = &c.OutboundBindAddressOR
+			} else if lower == "outboundbindaddressexit" {
+				ba = &c.OutboundBindAddressExit
+			}
+			if err := ba.Add(matches[2]); err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+
+		case "ipv6exit", "exitportstatistics", "servedirport":
+			if matches[2] != "0" && matches[2] != "1" {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			if lower == "ipv6exit" {
+				c.IPv6Exit = matches[2] == "1"
+			} else if lower == "exitportstatistics" {
+				c.ExitPortStatistics = matches[2] == "1"
+			} else if lower == "servedirport" {
+				c.ServeDirPort = matches[2] == "1"
+			}
+
+		case "refusetap", "createfastfromclientsonly":
+			if matches[2] != "0" && matches[2] != "1" {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			if lower == "refusetap" {
+				c.RefuseTAP = matches[2] == "1"
+			} else if lower == "createfastfromclientsonly" {
+				c.CreateFastFromClientsOnly = matches[2] == "1"
+			}
+
+		case "doscircuitcreationenabled", "dosconnectionenabled":
+			if matches[2] != "0" && matches[2] != "1" {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			if lower == "doscircuitcreationenabled" {
+				c.DoSCircuitCreationEnabled = matches[2] == "1"
+			} else if lower == "dosconnectionenabled" {
+				c.DoSConnectionEnabled = matches[2] == "1"
+			}
+
+		case "doscircuitcreationminconnections", "doscircuitcreationrate", "doscircuitcreationburst", "dosconnectionmaxconcurrentcount":
+			val_, err := strconv.ParseUint(matches[2], 10, 31)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+
+			val := int(val_)
+			if lower == "doscircuitcreationminconnections" {
+				c.DoSCircuitCreationMinConnections = val
+			} else if lower == "doscircuitcreationrate" {
+				c.DoSCircuitCreationRate = val
+			} else if lower == "doscircuitcreationburst" {
+				c.DoSCircuitCreationBurst = val
+			} else if lower == "dosconnectionmaxconcurrentcount" {
+				c.DoSConnectionMaxConcurrentCount = val
+			}
+
+		case "maxstreamspercircuit", "maxstreamsperconnection", "maxexitsockets":
+			val, err := strconv.ParseUint(matches[2], 10, 31)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+
+			if lower == "maxstreamspercircuit" {
+				c.MaxStreamsPerCircuit = int(val)
+			} else if lower == "maxstreamsperconnection" {
+				c.MaxStreamsPerConnection = int(val)
+			} else if lower == "maxexitsockets" {
+				c.MaxExitSockets = int(val)
+			}
+
+		case "maxmeminqueues":
+			m := memunitRe.FindStringSubmatch(matches[2])
+			if m == nil {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			val, err := strconv.ParseInt(m[1], 10, 32)
+			if err != nil {
+				return err
+			}
+
+			switch strings.ToLower(m[2]) {
+			case "kb", "kbyte", "kbytes":
+				val <<= 10
+			case "mb", "mbyte", "mbytes":
+				val <<= 20
+			case "gb", "gbyte", "gbytes":
+				val <<= 30
+			}
+			c.MaxMemInQueues = val
+
+		case "numcpus":
+			val, err := strconv.ParseUint(matches[2], 10, 16)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+			c.NumCPUs = int(val)
+
+		case "sendmeemitminversion", "sendmeacceptminversion":
+			if matches[2] != "0" && matches[2] != "1" {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			if lower == "sendmeemitminversion" {
+				c.SendMeEmitMinVersion = int(matches[2][0] - '0')
+			} else if lower == "sendmeacceptminversion" {
+				c.SendMeAcceptMinVersion = int(matches[2][0] - '0')
+			}
+
+		case "circuitpriorityhalflife":
+			d, err := parseInterval(matches[2])
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+			c.CircuitPriorityHalflife = d
+
+		case "maxonionqueuedelay":
+			d, err := parseInterval(matches[2])
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+			c.MaxOnionQueueDelay = d
+
+		case "doscircuitcreationdefensetimeperiod":
+			d, err := parseInterval(matches[2])
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q: %s", matches[1], matches[2], err)
+			}
+			c.DoSCircuitCreationDefenseTimePeriod = d
+
 		default:
 			log.Printf("Configuration option %q not recognized. Ignoring its value\n", matches[1])
 		}
@@ -153,3 +373,86 @@ func (c *Config) ReadFile(filename string) error {
 
 	return nil
 }
+
+// One IPv4 and one IPv6 address, either of which may be unset
+type BindAddresses struct {
+	IPv4, IPv6 net.IP
+}
+
+func (ba *BindAddresses) Add(value string) error {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return errors.New("not an IP address")
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if ba.IPv4 != nil {
+			return errors.New("only one IPv4 address may be given")
+		}
+		ba.IPv4 = ip4
+	} else {
+		if ba.IPv6 != nil {
+			return errors.New("only one IPv6 address may be given")
+		}
+		ba.IPv6 = ip
+	}
+	return nil
+}
+
+func (ba *BindAddresses) forRemote(remote net.IP) net.IP {
+	if remote == nil {
+		return nil
+	}
+	if remote.To4() != nil {
+		return ba.IPv4
+	}
+	return ba.IPv6
+}
+
+// The local address to use for a connection to remote, or nil to let the kernel choose
+func (c *Config) OutboundBindAddr(exit bool, remote net.IP) net.Addr {
+	specific := &c.OutboundBindAddressOR
+	if exit {
+		specific = &c.OutboundBindAddressExit
+	}
+
+	ip := specific.forRemote(remote)
+	if ip == nil {
+		ip = c.OutboundBindAddress.forRemote(remote)
+	}
+	if ip == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+var memunitRe = regexp.MustCompile(`^(?i)([0-9]+)\s*(bytes?|kb|kbytes?|mb|mbytes?|gb|gbytes?)$`)
+var intervalRe = regexp.MustCompile(`^(?i)([0-9]+)\s*(msecs?|milliseconds?|seconds?|minutes?|hours?|days?|weeks?)?$`)
+
+func parseInterval(value string) (time.Duration, error) {
+	m := intervalRe.FindStringSubmatch(value)
+	if m == nil {
+		return 0, errors.New("not a time interval")
+	}
+
+	val, err := strconv.ParseInt(m[1], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	unit := time.Second
+	switch strings.ToLower(m[2]) {
+	case "msec", "msecs", "millisecond", "milliseconds":
+		unit = time.Millisecond
+	case "minute", "minutes":
+		unit = time.Minute
+	case "hour", "hours":
+		unit = time.Hour
+	case "day", "days":
+		unit = 24 * time.Hour
+	case "week", "weeks":
+		unit = 7 * 24 * time.Hour
+	}
+
+	return time.Duration(val) * unit, nil
+}
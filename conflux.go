@@ -0,0 +1,623 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conflux (proposal 329): a client links several circuits ending at us into one set, and spreads its stream
+// messages over them. Stream messages carry an implicit sequence number that is shared by the whole set, so we
+// can put them back in order no matter which leg they arrived on.
+//
+// The legs usually reach us over different connections, and each connection only touches its own circuits.
+// One leg, the home leg, owns the set's streams and sequence numbers. The other legs pass the stream messages
+// they receive on to the home leg, and the home leg hands the messages it sends to the leg it picks.
+//
+// When the home leg goes away, another leg becomes the home leg and the streams move there. Whatever was still on
+// its way to the old home leg is passed on as well, and stream commands carry their own sequence numbers so that
+// the new home leg can put them back in order (see handleStreamCommand). Until the streams arrive, the new home
+// leg holds on to what it gets.
+//
+// Legs never wait for each other: if a message can't be handed over, or a message we were sending on a leg was
+// lost because the leg went away, the set can no longer keep its streams in order and we close all of it. A leg
+// can also go away while the client had messages in flight on it, in which case the set stalls until the circuit
+// sweep closes it.
+
+const (
+	CONFLUX_VERSION       = 1
+	CONFLUX_NONCE_LEN     = 32
+	CONFLUX_LINK_LEN      = 1 + CONFLUX_NONCE_LEN + 8 + 8 + 1
+	CONFLUX_MAX_LEGS      = 8
+	CONFLUX_MAX_QUEUED    = 1000 // Out of order messages we are willing to hold on to per set
+	CONFLUX_STALL_TIMEOUT = 30 * time.Second
+)
+
+// What the client asks us to optimize for when picking a leg
+const (
+	CONFLUX_UX_NO_OPINION         = 0
+	CONFLUX_UX_MIN_LATENCY        = 1
+	CONFLUX_UX_LOW_MEM_LATENCY    = 2
+	CONFLUX_UX_HIGH_THROUGHPUT    = 3
+	CONFLUX_UX_LOW_MEM_THROUGHPUT = 4
+)
+
+type ConfluxSet struct {
+	nonce [CONFLUX_NONCE_LEN]byte
+
+	lock   sync.Mutex
+	legs   []*confluxLeg
+	home   *confluxLeg
+	ux     byte
+	window *Window // Shared by all legs, so that streams can use the room on any of them
+	failed int32
+
+	// Only used by the home leg. The sequence numbers are also read by new legs, so they are updated atomically
+	lastSeqSent      uint64
+	lastSeqDelivered uint64
+	sendLeg          *confluxLeg
+	pending          map[uint64]*RelayMessage
+	pendingSince     time.Time
+}
+
+type confluxLeg struct {
+	set    *ConfluxSet
+	circID CircuitID
+	queue  CircReadQueue
+	linked int32 // Set once the client confirmed with LINKED_ACK
+
+	// Kept up to date by the leg's own connection, for pickLeg
+	rtt      int64 // Our latest RTT estimate, as a time.Duration
+	cwnd     int64
+	inflight int64 // Cells the home leg sent on this leg that weren't acknowledged yet
+
+	// Only used by the leg's own connection
+	lastSeqRecv uint64
+	ownsStreams bool             // Set on the home leg once it has the streams
+	held        []CircuitCommand // What reached a new home leg before the streams did
+
+	// Only used by the home leg
+	lastSeqSent uint64
+}
+
+// The stream-level commands are the ones that get sequence numbers
+func confluxMultiplexed(cmd RelayCommand) bool {
+	return relayCommandHasStreamID(cmd)
+}
+
+func (or *ORCtx) confluxJoin(nonce []byte, leg *confluxLeg, window *Window, ux byte) (*ConfluxSet, error) {
+	or.confluxLock.Lock()
+	defer or.confluxLock.Unlock()
+
+	var key [CONFLUX_NONCE_LEN]byte
+	copy(key[:], nonce)
+
+	set, ok := or.confluxSets[key]
+	if !ok {
+		set = &ConfluxSet{
+			nonce:   key,
+			home:    leg,
+			window:  window,
+			pending: make(map[uint64]*RelayMessage),
+		}
+		or.confluxSets[key] = set
+		leg.ownsStreams = true
+	}
+
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	if len(set.legs) >= CONFLUX_MAX_LEGS {
+		return nil, errors.New("too many conflux legs")
+	}
+	if ok {
+		set.window.Refill(window.GetLevel())
+	}
+	set.legs = append(set.legs, leg)
+	set.ux = ux // The latest LINK wins
+	leg.set = set
+
+	return set, nil
+}
+
+func (c *OnionConnection) handleRelayConfluxLink(circ *Circuit, msg *RelayMessage) ActionableError {
+	if circ.nextHop != nil || circ.extendState != nil {
+		return CloseCircuit(errors.New("conflux LINK on a circuit that isn't ours"), DESTROY_REASON_PROTOCOL)
+	}
+	if circ.conflux != nil {
+		return CloseCircuit(errors.New("circuit is already linked"), DESTROY_REASON_PROTOCOL)
+	}
+	if circ.cc == nil {
+		return CloseCircuit(errors.New("conflux requires congestion control"), DESTROY_REASON_PROTOCOL)
+	}
+	if len(circ.streams) != 0 {
+		return CloseCircuit(errors.New("conflux LINK on a circuit with streams"), DESTROY_REASON_PROTOCOL)
+	}
+
+	data := msg.Data()
+	if len(data) < CONFLUX_LINK_LEN || data[0] != CONFLUX_VERSION {
+		return CloseCircuit(errors.New("malformed conflux LINK"), DESTROY_REASON_PROTOCOL)
+	}
+	nonce := data[1 : 1+CONFLUX_NONCE_LEN]
+	theirLastSent := BigEndian.Uint64(data[1+CONFLUX_NONCE_LEN:])
+	theirLastRecv := BigEndian.Uint64(data[1+CONFLUX_NONCE_LEN+8:])
+	desiredUX := data[CONFLUX_LINK_LEN-1]
+	if desiredUX > CONFLUX_UX_LOW_MEM_THROUGHPUT {
+		return CloseCircuit(fmt.Errorf("unknown conflux UX %d", desiredUX), DESTROY_REASON_PROTOCOL)
+	}
+
+	leg := &confluxLeg{
+		circID: circ.id,
+		queue:  c.circuitReadQueue,
+		cwnd:   int64(circ.cc.cwnd),
+
+		// The leg picks up where the set is, from the client's point of view
+		lastSeqRecv: theirLastSent,
+		lastSeqSent: theirLastRecv,
+	}
+	set, err := c.parentOR.confluxJoin(nonce, leg, circ.backwardWindow, desiredUX)
+	if err != nil {
+		return CloseCircuit(err, DESTROY_REASON_RESOURCELIMIT)
+	}
+	circ.conflux = leg
+	circ.backwardWindow = set.window
+
+	reply := make([]byte, CONFLUX_LINK_LEN)
+	reply[0] = CONFLUX_VERSION
+	copy(reply[1:], nonce)
+	BigEndian.PutUint64(reply[1+CONFLUX_NONCE_LEN:], atomic.LoadUint64(&set.lastSeqSent))
+	BigEndian.PutUint64(reply[1+CONFLUX_NONCE_LEN+8:], atomic.LoadUint64(&set.lastSeqDelivered))
+	reply[CONFLUX_LINK_LEN-1] = desiredUX
+
+	return c.sendRelayCell(circ, 0, BackwardDirection, RELAY_CONFLUX_LINKED, reply)
+}
+
+func (c *OnionConnection) handleRelayConfluxLinkedAck(circ *Circuit, msg *RelayMessage) ActionableError {
+	if circ.conflux == nil {
+		return CloseCircuit(errors.New("LINKED_ACK on a circuit that isn't linked"), DESTROY_REASON_PROTOCOL)
+	}
+	atomic.StoreInt32(&circ.conflux.linked, 1)
+	return nil
+}
+
+func (c *OnionConnection) handleRelayConfluxSwitch(circ *Circuit, msg *RelayMessage) ActionableError {
+	if circ.conflux == nil {
+		return CloseCircuit(errors.New("SWITCH on a circuit that isn't linked"), DESTROY_REASON_PROTOCOL)
+	}
+	if msg.Length() < 4 {
+		return CloseCircuit(errors.New("malformed conflux SWITCH"), DESTROY_REASON_PROTOCOL)
+	}
+
+	// They sent this many messages on the other legs since they last used this one
+	circ.conflux.lastSeqRecv += uint64(BigEndian.Uint32(msg.Data()[0:4]))
+	return nil
+}
+
+func (set *ConfluxSet) isFailed() bool {
+	return atomic.LoadInt32(&set.failed) != 0
+}
+
+// Gives up on the set. Legs we can't reach right away close themselves the next time they look at the set.
+func (set *ConfluxSet) fail() {
+	if !atomic.CompareAndSwapInt32(&set.failed, 0, 1) {
+		return
+	}
+
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	Log(LOG_CIRC, "Closing a conflux set of %d legs", len(set.legs))
+	for _, leg := range set.legs {
+		select {
+		case leg.queue <- &ConfluxClose{circID: leg.circID, leg: leg}:
+		default:
+		}
+	}
+}
+
+// Hands a command to the connection of another leg. Never blocks: if their queue is full, the set is given up on.
+func (set *ConfluxSet) handOver(queue CircReadQueue, cmd CircuitCommand) ActionableError {
+	select {
+	case queue <- cmd:
+		return nil
+	default:
+		set.fail()
+		return CloseCircuit(errors.New("conflux leg is not keeping up"), DESTROY_REASON_RESOURCELIMIT)
+	}
+}
+
+var errConfluxSetClosed = CloseCircuit(errors.New("conflux set was closed"), DESTROY_REASON_FINISHED)
+
+// Closes a leg of a set that failed
+type ConfluxClose struct {
+	NeverForRelay
+	NoBuffers
+	circID CircuitID
+	leg    *confluxLeg
+}
+
+func (m *ConfluxClose) CircID() CircuitID {
+	return m.circID
+}
+
+func (m *ConfluxClose) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	if circ.conflux != m.leg {
+		return nil // The circuit ID got reused
+	}
+	return errConfluxSetClosed
+}
+
+// A stream message that arrived on one leg, on its way to the home leg
+type ConfluxMessage struct {
+	NeverForRelay
+	NoBuffers
+	circID CircuitID
+	home   *confluxLeg
+	seq    uint64
+	msg    *RelayMessage
+}
+
+func (m *ConfluxMessage) CircID() CircuitID {
+	return m.circID
+}
+
+func (m *ConfluxMessage) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	if circ.conflux != m.home {
+		m.Undeliverable()
+		return nil
+	}
+	return c.confluxDeliver(circ, m)
+}
+
+// The home leg went away. If the set lives on, the message goes to the new home leg.
+func (m *ConfluxMessage) Undeliverable() {
+	set := m.home.set
+	set.lock.Lock()
+	home, alive := set.home, len(set.legs) != 0
+	set.lock.Unlock()
+
+	if !alive || home == m.home {
+		set.fail()
+		return
+	}
+	m.circID = home.circID
+	m.home = home
+	set.handOver(home.queue, m)
+}
+
+// Called on the leg a stream message came in on
+func (c *OnionConnection) confluxReceive(circ *Circuit, msg *RelayMessage) ActionableError {
+	leg := circ.conflux
+	set := leg.set
+	if set.isFailed() {
+		return errConfluxSetClosed
+	}
+	leg.lastSeqRecv++
+
+	// The cell's buffer gets reused once we return
+	m := &ConfluxMessage{
+		seq: leg.lastSeqRecv,
+		msg: &RelayMessage{
+			command:  msg.command,
+			streamID: msg.streamID,
+			data:     append([]byte(nil), msg.data...),
+		},
+	}
+
+	set.lock.Lock()
+	home := set.home
+	set.lock.Unlock()
+
+	m.circID = home.circID
+	m.home = home
+	if home == leg {
+		return c.confluxDeliver(circ, m)
+	}
+	return set.handOver(home.queue, m)
+}
+
+// Called on the home leg: processes the messages of the set in order
+func (c *OnionConnection) confluxDeliver(circ *Circuit, m *ConfluxMessage) ActionableError {
+	set := circ.conflux.set
+	if set.isFailed() {
+		return errConfluxSetClosed
+	}
+	if !circ.conflux.ownsStreams {
+		return c.confluxHold(circ, m)
+	}
+	if m.seq <= set.lastSeqDelivered {
+		return CloseCircuit(fmt.Errorf("conflux sequence number %d was already used", m.seq), DESTROY_REASON_PROTOCOL)
+	}
+	if m.seq != set.lastSeqDelivered+1 {
+		if len(set.pending) >= CONFLUX_MAX_QUEUED {
+			return CloseCircuit(errors.New("too many out of order conflux messages"), DESTROY_REASON_RESOURCELIMIT)
+		}
+		if len(set.pending) == 0 {
+			set.pendingSince = time.Now()
+		}
+		set.pending[m.seq] = m.msg
+		return nil
+	}
+
+	msg := m.msg
+	for msg != nil {
+		atomic.AddUint64(&set.lastSeqDelivered, 1)
+		if err := c.handleRelayMessage(circ, nil, msg); err != nil {
+			return err
+		}
+
+		msg = set.pending[set.lastSeqDelivered+1]
+		delete(set.pending, set.lastSeqDelivered+1)
+	}
+	if len(set.pending) != 0 {
+		set.pendingSince = time.Now()
+	}
+	return nil
+}
+
+// Whether the circuit sweep should close this leg: its set failed, or it is the home leg and has been waiting for
+// a missing message for too long
+func (leg *confluxLeg) shouldClose(now time.Time) bool {
+	set := leg.set
+	if set.isFailed() {
+		return true
+	}
+
+	set.lock.Lock()
+	isHome := set.home == leg
+	set.lock.Unlock()
+
+	return isHome && len(set.pending) != 0 && now.Sub(set.pendingSince) > CONFLUX_STALL_TIMEOUT
+}
+
+// Picks the leg to send on. Latency: the linked leg with the lowest RTT. Throughput: the same, but only among
+// the legs that have room in their congestion window, so that we use all of them once the fast one is full.
+func (set *ConfluxSet) pickLeg() *confluxLeg {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+
+	throughput := set.ux == CONFLUX_UX_HIGH_THROUGHPUT || set.ux == CONFLUX_UX_LOW_MEM_THROUGHPUT
+
+	var best, fastest *confluxLeg
+	var bestRTT, fastestRTT int64
+	for _, leg := range set.legs {
+		if atomic.LoadInt32(&leg.linked) == 0 {
+			continue
+		}
+		rtt := atomic.LoadInt64(&leg.rtt)
+		if fastest == nil || (rtt != 0 && (fastestRTT == 0 || rtt < fastestRTT)) {
+			fastest, fastestRTT = leg, rtt
+		}
+		if throughput && atomic.LoadInt64(&leg.inflight) >= atomic.LoadInt64(&leg.cwnd) {
+			continue
+		}
+		if best == nil || (rtt != 0 && (bestRTT == 0 || rtt < bestRTT)) {
+			best, bestRTT = leg, rtt
+		}
+	}
+	if best == nil {
+		best = fastest
+	}
+	if best == nil {
+		best = set.home
+	}
+	return best
+}
+
+// A stream message the home leg wants sent on another leg
+type ConfluxSend struct {
+	NeverForRelay
+	NoBuffers
+	circID   CircuitID
+	leg      *confluxLeg
+	streamID StreamID
+	command  RelayCommand
+	data     []byte
+}
+
+func (s *ConfluxSend) CircID() CircuitID {
+	return s.circID
+}
+
+func (s *ConfluxSend) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	if circ.conflux != s.leg {
+		s.Undeliverable()
+		return nil
+	}
+	if s.leg.set.isFailed() {
+		return errConfluxSetClosed
+	}
+	return c.sendRelayCellOn(circ, s.streamID, BackwardDirection, s.command, s.data)
+}
+
+// The leg went away before it could send this, so the client will never see it
+func (s *ConfluxSend) Undeliverable() {
+	s.leg.set.fail()
+}
+
+// Called on the home leg for every stream message we send
+func (c *OnionConnection) confluxSend(circ *Circuit, stream StreamID, command RelayCommand, data []byte) ActionableError {
+	set := circ.conflux.set
+	if set.isFailed() {
+		return errConfluxSetClosed
+	}
+
+	leg := set.pickLeg()
+	if leg != set.sendLeg {
+		// Tell them how far along the set is, from the point of view of the new leg
+		var payload [4]byte
+		BigEndian.PutUint32(payload[:], uint32(set.lastSeqSent-leg.lastSeqSent))
+		if err := c.confluxSendOn(circ, leg, 0, RELAY_CONFLUX_SWITCH, payload[:]); err != nil {
+			return err
+		}
+		set.sendLeg = leg
+	}
+
+	atomic.AddUint64(&set.lastSeqSent, 1)
+	leg.lastSeqSent = set.lastSeqSent
+	if command == RELAY_DATA {
+		atomic.AddInt64(&leg.inflight, 1)
+	}
+	return c.confluxSendOn(circ, leg, stream, command, data)
+}
+
+func (c *OnionConnection) confluxSendOn(circ *Circuit, leg *confluxLeg, stream StreamID, command RelayCommand, data []byte) ActionableError {
+	if leg == circ.conflux {
+		return c.sendRelayCellOn(circ, stream, BackwardDirection, command, data)
+	}
+
+	return leg.set.handOver(leg.queue, &ConfluxSend{
+		circID:   leg.circID,
+		leg:      leg,
+		streamID: stream,
+		command:  command,
+		data:     append([]byte(nil), data...),
+	})
+}
+
+// Called on a new home leg for what it gets before the streams
+func (c *OnionConnection) confluxHold(circ *Circuit, cmd CircuitCommand) ActionableError {
+	leg := circ.conflux
+	if len(leg.held) >= CONFLUX_MAX_QUEUED {
+		return CloseCircuit(errors.New("too many conflux messages waiting for their streams"), DESTROY_REASON_RESOURCELIMIT)
+	}
+	leg.held = append(leg.held, cmd)
+	return nil
+}
+
+// Makes another leg the home leg
+type ConfluxAdopt struct {
+	NeverForRelay
+	NoBuffers
+	circID  CircuitID
+	leg     *confluxLeg
+	streams map[StreamID]*Stream // Nil if the old home leg was still waiting for them itself
+	held    []CircuitCommand
+}
+
+func (m *ConfluxAdopt) CircID() CircuitID {
+	return m.circID
+}
+
+func (m *ConfluxAdopt) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	leg := m.leg
+	if circ.conflux != leg {
+		m.Undeliverable()
+		return nil
+	}
+
+	leg.held = append(leg.held, m.held...)
+	if m.streams == nil {
+		return nil
+	}
+	leg.ownsStreams = true
+	for id, stream := range m.streams {
+		circ.streams[id] = stream
+	}
+
+	held := leg.held
+	leg.held = nil
+	for i, cmd := range held {
+		err := cmd.Handle(c, circ)
+		cmd.ReleaseBuffers()
+		if err != nil {
+			for _, cmd := range held[i+1:] {
+				cmd.ReleaseBuffers()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// The new home leg went away as well, so try the one after it
+func (m *ConfluxAdopt) Undeliverable() {
+	set := m.leg.set
+	set.lock.Lock()
+	home, alive := set.home, len(set.legs) != 0
+	set.lock.Unlock()
+
+	if alive && home != m.leg && !set.isFailed() {
+		m.circID = home.circID
+		m.leg = home
+		for _, stream := range m.streams {
+			stream.SetRoute(home.circID, home.queue, home)
+		}
+		if set.handOver(home.queue, m) == nil {
+			return
+		}
+	}
+
+	for _, stream := range m.streams {
+		stream.Destroy()
+	}
+	for _, cmd := range m.held {
+		cmd.ReleaseBuffers()
+	}
+}
+
+// Called when a leg is destroyed. Returns whether the set lives on, in which case the window must be left alone.
+func (c *OnionConnection) confluxLegClosed(circ *Circuit) bool {
+	leg := circ.conflux
+	set := leg.set
+
+	c.parentOR.confluxLock.Lock()
+	set.lock.Lock()
+	for i, l := range set.legs {
+		if l == leg {
+			set.legs = append(set.legs[:i], set.legs[i+1:]...)
+			break
+		}
+	}
+	if len(set.legs) == 0 {
+		delete(c.parentOR.confluxSets, set.nonce)
+	}
+	remaining := len(set.legs) != 0
+	var newHome *confluxLeg
+	if set.home == leg && remaining {
+		newHome = set.legs[0]
+		set.home = newHome
+	}
+	set.lock.Unlock()
+	c.parentOR.confluxLock.Unlock()
+
+	if newHome != nil && !set.isFailed() {
+		// XXX the streams keep using our queue account, which stops counting once we're gone
+		adopt := &ConfluxAdopt{
+			circID: newHome.circID,
+			leg:    newHome,
+			held:   leg.held,
+		}
+		if leg.ownsStreams {
+			adopt.streams = circ.streams
+			for _, stream := range circ.streams {
+				stream.SetRoute(newHome.circID, newHome.queue, newHome)
+			}
+		}
+		if set.handOver(newHome.queue, adopt) == nil {
+			circ.streams = make(map[StreamID]*Stream)
+			leg.held = nil
+		}
+	}
+	for _, cmd := range leg.held {
+		cmd.ReleaseBuffers()
+	}
+	return remaining && !set.isFailed()
+}
+
+// Keeps what pickLeg goes by up to date
+func (circ *Circuit) confluxNoteSendme() {
+	if circ.conflux != nil && circ.cc != nil {
+		atomic.StoreInt64(&circ.conflux.rtt, int64(circ.cc.ewmaRTT))
+		atomic.StoreInt64(&circ.conflux.cwnd, int64(circ.cc.cwnd))
+		if atomic.AddInt64(&circ.conflux.inflight, -int64(circ.cc.sendmeInc)) < 0 {
+			atomic.StoreInt64(&circ.conflux.inflight, 0)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func newConfluxTestLeg(t *testing.T, c *OnionConnection, id CircuitID, ux byte) *Circuit {
+	circ := NewCircuit(id, make([]byte, 20), make([]byte, 20), make([]byte, 16), make([]byte, 16))
+	circ.cc = NewCongestionControl(CC_SENDME_INC)
+	circ.cells = c.scheduler.NewQueue(nil)
+	c.circuits[id] = circ
+
+	leg := &confluxLeg{circID: id, queue: c.circuitReadQueue, linked: 1}
+	set, err := c.parentOR.confluxJoin(make([]byte, CONFLUX_NONCE_LEN), leg, circ.backwardWindow, ux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circ.conflux = leg
+	circ.backwardWindow = set.window
+	return circ
+}
+
+func drainCircuitQueue(t *testing.T, c *OnionConnection) {
+	for len(c.circuitReadQueue) != 0 {
+		cmd := <-c.circuitReadQueue
+		if err := c.routeCircuitCommandToFunction(cmd); err != nil {
+			t.Fatal(err)
+		}
+		cmd.ReleaseBuffers()
+	}
+}
+
+func TestConfluxHomeLegClosed(t *testing.T) {
+	or := &ORCtx{config: &Config{}, confluxSets: make(map[[CONFLUX_NONCE_LEN]byte]*ConfluxSet)}
+	c1 := newOnionConnection(nil, or)
+	c2 := newOnionConnection(nil, or)
+	home := newConfluxTestLeg(t, c1, 1, CONFLUX_UX_NO_OPINION)
+	other := newConfluxTestLeg(t, c2, 1, CONFLUX_UX_NO_OPINION)
+	set := home.conflux.set
+
+	stream, _ := NewStream(5, true)
+	home.streams[5] = stream
+	stream.SetRoute(home.id, c1.circuitReadQueue, home.conflux)
+
+	data := func(s string) *RelayMessage {
+		return &RelayMessage{command: RELAY_DATA, streamID: 5, data: []byte(s)}
+	}
+
+	// The home leg goes away while the other leg is passing it messages, and while the stream is talking to it
+	if err := c1.confluxReceive(home, data("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.handleRelayConfluxSwitch(other, &RelayMessage{command: RELAY_CONFLUX_SWITCH, data: []byte{0, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"b", "c"} {
+		if err := c2.confluxReceive(other, data(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.send(&StreamControl{streamID: 5, data: STREAM_HALF_CLOSED, reason: STREAM_REASON_DONE})
+	c1.destroyCircuit(home, false, true, DESTROY_REASON_OR_CONN_CLOSED)
+
+	stream.send(&StreamControl{streamID: 5, data: STREAM_XOFF})
+	if err := c2.confluxReceive(other, data("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	drainCircuitQueue(t, c1)
+	drainCircuitQueue(t, c2)
+
+	if set.isFailed() {
+		t.Fatal("set did not survive losing its home leg")
+	}
+	var received string
+	for len(stream.writeChan) != 0 {
+		received += string(<-stream.writeChan)
+	}
+	if received != "abcd" {
+		t.Fatalf("stream received %q", received)
+	}
+	if !stream.endSent || stream.handledSeq != 2 || len(stream.early) != 0 || other.streams[5] != stream {
+		t.Fatal("stream commands were not all handled")
+	}
+
+	c2.destroyCircuit(other, false, true, DESTROY_REASON_FINISHED)
+	if len(or.confluxSets) != 0 {
+		t.Fatal("set was not removed")
+	}
+}
+
+func TestConfluxLinkSequenceNumbers(t *testing.T) {
+	or := &ORCtx{config: &Config{}, confluxSets: make(map[[CONFLUX_NONCE_LEN]byte]*ConfluxSet)}
+	c := newOnionConnection(nil, or)
+	home := newConfluxTestLeg(t, c, 1, CONFLUX_UX_NO_OPINION)
+	home.conflux.set.lastSeqSent = 5
+	home.conflux.set.lastSeqDelivered = 7
+
+	circ := NewCircuit(2, make([]byte, 20), make([]byte, 20), make([]byte, 16), make([]byte, 16))
+	circ.cc = NewCongestionControl(CC_SENDME_INC)
+	circ.cells = c.scheduler.NewQueue(nil)
+
+	data := make([]byte, CONFLUX_LINK_LEN)
+	data[0] = CONFLUX_VERSION
+	BigEndian.PutUint64(data[1+CONFLUX_NONCE_LEN:], 7)
+	BigEndian.PutUint64(data[1+CONFLUX_NONCE_LEN+8:], 5)
+	if err := c.handleRelayConfluxLink(circ, &RelayMessage{command: RELAY_CONFLUX_LINK, data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if circ.conflux.set != home.conflux.set {
+		t.Fatal("circuit did not join the set")
+	}
+
+	// The client's next message on the new leg is the set's next one
+	if err := c.confluxReceive(circ, &RelayMessage{command: RELAY_DATA, streamID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	drainCircuitQueue(t, c)
+	if home.conflux.set.lastSeqDelivered != 8 {
+		t.Fatalf("message was not delivered, at %d", home.conflux.set.lastSeqDelivered)
+	}
+}
+
+func TestConfluxHandOverDoesNotBlock(t *testing.T) {
+	or := &ORCtx{config: &Config{}, confluxSets: make(map[[CONFLUX_NONCE_LEN]byte]*ConfluxSet)}
+	c1 := newOnionConnection(nil, or)
+	c2 := newOnionConnection(nil, or)
+	home := newConfluxTestLeg(t, c1, 1, CONFLUX_UX_NO_OPINION)
+	other := newConfluxTestLeg(t, c2, 1, CONFLUX_UX_NO_OPINION)
+
+	for len(c1.circuitReadQueue) != cap(c1.circuitReadQueue) {
+		c1.circuitReadQueue <- &ConfluxClose{circID: 2}
+	}
+	if err := c2.confluxReceive(other, &RelayMessage{command: RELAY_DATA, streamID: 1}); err == nil || err.Handle() != ERROR_CLOSE_CIRCUIT {
+		t.Fatalf("expected the leg to close, got %v", err)
+	}
+	if !home.conflux.set.isFailed() {
+		t.Fatal("set survived a lost message")
+	}
+}
+
+func TestConfluxPickLeg(t *testing.T) {
+	fast := &confluxLeg{linked: 1, rtt: 10, cwnd: 100, inflight: 100}
+	slow := &confluxLeg{linked: 1, rtt: 50, cwnd: 100, inflight: 10}
+	set := &ConfluxSet{legs: []*confluxLeg{slow, fast}, home: slow}
+
+	for _, ux := range []byte{CONFLUX_UX_NO_OPINION, CONFLUX_UX_MIN_LATENCY, CONFLUX_UX_LOW_MEM_LATENCY} {
+		set.ux = ux
+		if set.pickLeg() != fast {
+			t.Errorf("UX %d did not pick the fastest leg", ux)
+		}
+	}
+	for _, ux := range []byte{CONFLUX_UX_HIGH_THROUGHPUT, CONFLUX_UX_LOW_MEM_THROUGHPUT} {
+		set.ux = ux
+		if set.pickLeg() != slow {
+			t.Errorf("UX %d picked a leg with a full congestion window", ux)
+		}
+	}
+
+	slow.inflight = 100
+	if set.pickLeg() != fast {
+		t.Error("expected the fastest leg once all windows are full")
+	}
+}
+
+func TestConfluxUnknownUX(t *testing.T) {
+	or := &ORCtx{config: &Config{}, confluxSets: make(map[[CONFLUX_NONCE_LEN]byte]*ConfluxSet)}
+	c := newOnionConnection(nil, or)
+	circ := NewCircuit(1, make([]byte, 20), make([]byte, 20), make([]byte, 16), make([]byte, 16))
+	circ.cc = NewCongestionControl(CC_SENDME_INC)
+
+	data := make([]byte, CONFLUX_LINK_LEN)
+	data[0] = CONFLUX_VERSION
+	data[CONFLUX_LINK_LEN-1] = CONFLUX_UX_LOW_MEM_THROUGHPUT + 1
+	err := c.handleRelayConfluxLink(circ, &RelayMessage{command: RELAY_CONFLUX_LINK, data: data})
+	if err == nil || err.Handle() != ERROR_CLOSE_CIRCUIT {
+		t.Fatalf("expected an unknown UX to be refused, got %v", err)
+	}
+	if len(or.confluxSets) != 0 {
+		t.Fatal("circuit was linked anyway")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Congestion control (proposal 324), using the Vegas algorithm like Tor's exits do. Circuits that negotiated it
+// replace the fixed circuit window with a congestion window that follows the measured RTT, and their streams use
+// XON/XOFF (proposal 344) instead of stream-level SENDMEs.
+//
+// The circuit's backwardWindow stays the mechanism that throttles our stream readers: its level is always
+// cwnd minus the cells in flight.
+
+const (
+	CC_SENDME_INC = 31
+	CC_CWND_INIT  = 4 * CC_SENDME_INC
+	CC_CWND_MIN   = 2 * CC_SENDME_INC
+	CC_CWND_MAX   = math.MaxInt32
+	CC_CWND_INC   = CC_SENDME_INC
+
+	// Vegas thresholds for exits, in cells of queue use
+	CC_VEGAS_ALPHA = 186
+	CC_VEGAS_BETA  = 248
+	CC_VEGAS_GAMMA = 186
+	CC_VEGAS_DELTA = 310
+	CC_VEGAS_SSCAP = 600
+
+	// XOFF once this many cells are waiting to be written to a stream's socket
+	STREAM_XOFF_CELLS = 250
+)
+
+type CongestionControl struct {
+	sendmeInc   int
+	cwnd        int
+	inSlowStart bool
+
+	minRTT, ewmaRTT time.Duration
+	sendTimes       []time.Time // When the cells that will be acknowledged by a SENDME were sent
+	ackedSinceAdj   int
+
+	delivered int // Cells received, for sending our own SENDMEs
+}
+
+func NewCongestionControl(sendmeInc int) *CongestionControl {
+	return &CongestionControl{
+		sendmeInc:   sendmeInc,
+		cwnd:        CC_CWND_INIT,
+		inSlowStart: true,
+	}
+}
+
+// Called for the cells a SENDME will acknowledge
+func (cc *CongestionControl) NoteSendmeCellSent(now time.Time) {
+	cc.sendTimes = append(cc.sendTimes, now)
+}
+
+// Returns true if we should send a SENDME for the cell we just received
+func (cc *CongestionControl) NoteCellDelivered() bool {
+	cc.delivered++
+	return cc.delivered%cc.sendmeInc == 0
+}
+
+// Processes a SENDME. Returns how much the circuit's package window changes
+func (cc *CongestionControl) HandleSendme(now time.Time) (int, error) {
+	if len(cc.sendTimes) == 0 {
+		return 0, errors.New("got a SENDME but we did not expect one")
+	}
+	sent := cc.sendTimes[0]
+	cc.sendTimes = cc.sendTimes[1:]
+
+	rtt := now.Sub(sent)
+	if rtt <= 0 {
+		rtt = time.Microsecond
+	}
+	if cc.minRTT == 0 || rtt < cc.minRTT {
+		cc.minRTT = rtt
+	}
+	if cc.ewmaRTT == 0 {
+		cc.ewmaRTT = rtt
+	} else {
+		// Average over roughly half a congestion window worth of SENDMEs
+		n := time.Duration(cc.cwnd / cc.sendmeInc / 2)
+		if n < 2 {
+			n = 2
+		}
+		cc.ewmaRTT = (rtt*2 + cc.ewmaRTT*(n-1)*2) / (n * 2)
+	}
+
+	oldCwnd := cc.cwnd
+	cc.ackedSinceAdj += cc.sendmeInc
+
+	bdp := int(int64(cc.cwnd) * int64(cc.minRTT) / int64(cc.ewmaRTT))
+	queueUse := cc.cwnd - bdp
+
+	if cc.inSlowStart {
+		if queueUse < CC_VEGAS_GAMMA {
+			cc.cwnd += cc.sendmeInc // Doubles the window every RTT
+		} else {
+			cc.cwnd = bdp + CC_VEGAS_GAMMA
+			cc.inSlowStart = false
+		}
+		if cc.cwnd >= CC_VEGAS_SSCAP {
+			cc.cwnd = CC_VEGAS_SSCAP
+			cc.inSlowStart = false
+		}
+	} else if cc.ackedSinceAdj >= cc.cwnd {
+		// Outside of slow start we adjust once per congestion window
+		cc.ackedSinceAdj = 0
+		if queueUse > CC_VEGAS_DELTA {
+			cc.cwnd = bdp + CC_VEGAS_DELTA - CC_CWND_INC
+		} else if queueUse > CC_VEGAS_BETA {
+			cc.cwnd -= CC_CWND_INC
+		} else if queueUse < CC_VEGAS_ALPHA {
+			cc.cwnd += CC_CWND_INC
+		}
+	}
+
+	if cc.cwnd < CC_CWND_MIN {
+		cc.cwnd = CC_CWND_MIN
+	}
+	if cc.cwnd > CC_CWND_MAX {
+		cc.cwnd = CC_CWND_MAX
+	}
+
+	return cc.sendmeInc + (cc.cwnd - oldCwnd), nil
+}
+
+func (c *OnionConnection) handleRelayXoff(circ *Circuit, msg *RelayMessage) ActionableError {
+	if circ.cc == nil {
+		return CloseCircuit(errors.New("got XOFF on a circuit without congestion control"), DESTROY_REASON_PROTOCOL)
+	}
+
+	stream, ok := circ.streams[msg.StreamID()]
+	if !ok {
+		Log(LOG_CIRC, "Ignoring XOFF for unknown stream")
+		return nil
+	}
+
+	stream.backwardWindow.Pause()
+	return nil
+}
+
+func (c *OnionConnection) handleRelayXon(circ *Circuit, msg *RelayMessage) ActionableError {
+	if circ.cc == nil {
+		return CloseCircuit(errors.New("got XON on a circuit without congestion control"), DESTROY_REASON_PROTOCOL)
+	}
+
+	stream, ok := circ.streams[msg.StreamID()]
+	if !ok {
+		Log(LOG_CIRC, "Ignoring XON for unknown stream")
+		return nil
+	}
+
+	// XXX we don't limit our rate to the kbps_ewma they send us
+	stream.backwardWindow.Resume()
+	return nil
+}
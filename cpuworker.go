@@ -0,0 +1,165 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Onionskins are expensive to process, so we don't do that on the connection's Runloop. Instead they're handed to
+// a pool of workers, and the result comes back to the connection on a channel of its own. Each connection only has
+// so many onionskins in flight, so that channel always has room for the results.
+
+const ONIONSKIN_QUEUE_LENGTH = 1000
+const MAX_PENDING_CREATES = 128 // Per connection
+
+const (
+	ONIONSKIN_PRIO_NTOR = iota
+	ONIONSKIN_PRIO_TAP
+
+	ONIONSKIN_PRIO_COUNT // must be last
+)
+
+type onionskinJob struct {
+	circID       CircuitID
+	handshake    HandshakeType
+	data         []byte
+	newHandshake bool
+	fingerprint  Fingerprint
+	ntorKey      *ntorKeyPair
+	resultQueue  chan *OnionskinResult
+	queued       time.Time
+}
+
+type OnionskinResult struct {
+	id           CircuitID
+	job          *onionskinJob
+	newHandshake bool
+	reply, keys  []byte
+	params       circuitParams // What they asked for in the ntor v3 extensions
+	err          ActionableError
+}
+
+type OnionskinStats struct {
+	Queued, Processed, Dropped, ProcessingNanos int64
+}
+
+type OnionskinPool struct {
+	or       *ORCtx
+	queues   [ONIONSKIN_PRIO_COUNT]chan *onionskinJob
+	deadline time.Duration
+
+	stats [ONIONSKIN_PRIO_COUNT]OnionskinStats
+}
+
+func NewOnionskinPool(or *ORCtx, workers int, deadline time.Duration) *OnionskinPool {
+	p := &OnionskinPool{
+		or:       or,
+		deadline: deadline,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan *onionskinJob, ONIONSKIN_QUEUE_LENGTH)
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+
+	return p
+}
+
+func onionskinPriority(handshake HandshakeType) int {
+	if handshake == HANDSHAKE_TAP {
+		return ONIONSKIN_PRIO_TAP
+	}
+	return ONIONSKIN_PRIO_NTOR
+}
+
+// Queues the job, unless the queue is full
+func (p *OnionskinPool) Submit(job *onionskinJob) bool {
+	prio := onionskinPriority(job.handshake)
+	job.queued = time.Now()
+
+	select {
+	case p.queues[prio] <- job:
+		atomic.AddInt64(&p.stats[prio].Queued, 1)
+		return true
+	default:
+		atomic.AddInt64(&p.stats[prio].Dropped, 1)
+		return false
+	}
+}
+
+func (p *OnionskinPool) worker() {
+	for {
+		var job *onionskinJob
+
+		// Only look at the TAP queue if we have no ntor work
+		select {
+		case job = <-p.queues[ONIONSKIN_PRIO_NTOR]:
+		default:
+			select {
+			case job = <-p.queues[ONIONSKIN_PRIO_NTOR]:
+			case job = <-p.queues[ONIONSKIN_PRIO_TAP]:
+			}
+		}
+
+		p.process(job)
+	}
+}
+
+func (p *OnionskinPool) process(job *onionskinJob) {
+	prio := onionskinPriority(job.handshake)
+	stats := &p.stats[prio]
+	atomic.AddInt64(&stats.Queued, -1)
+
+	result := &OnionskinResult{
+		id:           job.circID,
+		job:          job,
+		newHandshake: job.newHandshake,
+	}
+
+	if p.deadline != 0 && time.Since(job.queued) > p.deadline {
+		atomic.AddInt64(&stats.Dropped, 1)
+		result.err = RefuseCircuit(errors.New("onionskin waited too long in the queue"), DESTROY_REASON_RESOURCELIMIT)
+	} else {
+		start := time.Now()
+		switch job.handshake {
+		case HANDSHAKE_TAP:
+			result.reply, result.keys, result.err = p.or.onionskinTAP(job.data)
+		case HANDSHAKE_NTOR:
+			result.reply, result.keys, result.err = p.or.onionskinNTOR(job.fingerprint, job.ntorKey, job.data)
+		case HANDSHAKE_NTOR3:
+			result.reply, result.keys, result.params, result.err = p.or.onionskinNTOR3(job.ntorKey, job.data)
+		default:
+			result.err = RefuseCircuit(errors.New("unknown handshake"), DESTROY_REASON_PROTOCOL)
+		}
+		atomic.AddInt64(&stats.Processed, 1)
+		atomic.AddInt64(&stats.ProcessingNanos, int64(time.Since(start)))
+	}
+
+	ReturnCellBuf(job.data)
+	job.data = nil
+
+	job.resultQueue <- result // Never blocks, see queueOnionskin
+}
+
+func (p *OnionskinPool) Stats() map[string]OnionskinStats {
+	load := func(s *OnionskinStats) OnionskinStats {
+		return OnionskinStats{
+			Queued:          atomic.LoadInt64(&s.Queued),
+			Processed:       atomic.LoadInt64(&s.Processed),
+			Dropped:         atomic.LoadInt64(&s.Dropped),
+			ProcessingNanos: atomic.LoadInt64(&s.ProcessingNanos),
+		}
+	}
+
+	return map[string]OnionskinStats{
+		"ntor": load(&p.stats[ONIONSKIN_PRIO_NTOR]),
+		"tap":  load(&p.stats[ONIONSKIN_PRIO_TAP]),
+	}
+}
@@ -18,14 +18,24 @@ import (
 type HandshakeType uint16
 
 const (
-	HANDSHAKE_TAP  HandshakeType = 0x00
-	HANDSHAKE_NTOR HandshakeType = 0x02
+	HANDSHAKE_TAP   HandshakeType = 0x00
+	HANDSHAKE_NTOR  HandshakeType = 0x02
+	HANDSHAKE_NTOR3 HandshakeType = 0x03
 )
 
 var dhKeyStr = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF"
 var dhKey []byte
 var funnyNtorHandshake = []byte("ntorNTORntorNTOR")
 
+func init() {
+	// Decoded up front, as the onionskin workers share it
+	key, err := hex.DecodeString(dhKeyStr)
+	if err != nil || key[0] != 255 || key[8] != 0xc9 {
+		panic(err)
+	}
+	dhKey = key
+}
+
 func (c *OnionConnection) handleCreateFast(cell Cell) ActionableError {
 	// XXX check for weAuthenticated (why?)
 
@@ -40,6 +50,15 @@ func (c *OnionConnection) handleCreateFast(cell Cell) ActionableError {
 		return CloseConnection(fmt.Errorf("refusing an invalid CircID %d %t", circID, c.isOutbound))
 	}
 
+	if c.parentOR.config.CreateFastFromClientsOnly && (c.theyAuthenticated || c.isOutbound) {
+		// Only clients building their first hop have a reason to use CREATE_FAST
+		return RefuseCircuit(errors.New("refusing CREATE_FAST from a relay"), DESTROY_REASON_PROTOCOL)
+	}
+
+	if c.dosAddr != "" && !c.parentOR.DoSCreateAllowed(c.dosAddr) {
+		return RefuseCircuit(errors.New("client exceeded circuit creation limits"), DESTROY_REASON_RESOURCELIMIT)
+	}
+
 	_, alreadyExists := c.circuits[cell.CircID()]
 	if alreadyExists {
 		return CloseConnection(errors.New("Circuit already exists"))
@@ -59,9 +78,11 @@ func (c *OnionConnection) handleCreateFast(cell Cell) ActionableError {
 	copy(writeCellData[20:40], keyData[0:20])
 
 	circ := NewCircuit(circID, keyData[20:40], keyData[40:60], keyData[60:76], keyData[76:92])
+	circ.queue = c.parentOR.NewQueueAccount(c.circuitReadQueue, circID, false)
+	circ.cells = c.scheduler.NewQueue(circ.queue)
 	c.circuits[circID] = circ
 
-	c.writeQueue <- writeCell.Bytes()
+	c.queueWrite(writeCell.Bytes())
 
 	return nil
 }
@@ -81,6 +102,10 @@ func (c *OnionConnection) handleCreate(cell Cell, newHandshake bool) ActionableE
 		return CloseConnection(errors.New("Not creating a circuit with id=0"))
 	}
 
+	if c.dosAddr != "" && !c.parentOR.DoSCreateAllowed(c.dosAddr) {
+		return RefuseCircuit(errors.New("client exceeded circuit creation limits"), DESTROY_REASON_RESOURCELIMIT)
+	}
+
 	var handshakeData []byte
 
 	if newHandshake {
@@ -108,71 +133,56 @@ func (c *OnionConnection) handleCreate(cell Cell, newHandshake bool) ActionableE
 	}
 
 	if handshake == HANDSHAKE_TAP {
+		if c.parentOR.config.RefuseTAP {
+			return RefuseCircuit(errors.New("refusing a TAP handshake"), DESTROY_REASON_PROTOCOL)
+		}
 		return c.handleCreateTAP(cell.CircID(), handshakeData, newHandshake)
 	} else if handshake == HANDSHAKE_NTOR {
 		return c.handleCreateNTOR(cell.CircID(), handshakeData, newHandshake)
+	} else if handshake == HANDSHAKE_NTOR3 && newHandshake {
+		return c.handleCreateNTOR3(cell.CircID(), handshakeData)
 	}
 
 	return RefuseCircuit(errors.New("unknown handshake"), DESTROY_REASON_PROTOCOL)
 }
 
-func (c *OnionConnection) handleCreateTAP(id CircuitID, data []byte, newHandshake bool) ActionableError {
-	theirData, err := HybridDecrypt(c.parentOR.onionKey, data[0:186])
-	if err != nil {
-		return RefuseCircuit(err, DESTROY_REASON_INTERNAL)
-	}
-
-	if len(theirData) != 128 {
-		return RefuseCircuit(errors.New("invalid TAP handshake found"), DESTROY_REASON_INTERNAL)
-	}
-
-	if dhKey == nil {
-		key, err := hex.DecodeString(dhKeyStr)
-		if err != nil || key[0] != 255 || key[8] != 0xc9 {
-			panic(err)
-		}
-		dhKey = key
+func (c *OnionConnection) queueOnionskin(circID CircuitID, handshake HandshakeType, data []byte, newHandshake bool, ntorKey *ntorKeyPair) ActionableError {
+	_, alreadyThere := c.circuits[circID]
+	_, pending := c.pendingCreates[circID]
+	if alreadyThere || pending {
+		return CloseConnection(errors.New("nope"))
 	}
-
-	dh, err := openssl.LoadDHFromBignumWithGenerator(dhKey, 2)
-	if err != nil {
-		return RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	if c.onionskinsInFlight >= MAX_PENDING_CREATES {
+		return RefuseCircuit(errors.New("too many pending creates on this connection"), DESTROY_REASON_RESOURCELIMIT)
 	}
 
-	pub, err := dh.GetPublicKey()
-	if err != nil {
-		return RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	job := &onionskinJob{
+		circID:       circID,
+		handshake:    handshake,
+		data:         GetCellBuf(false)[0:len(data)],
+		newHandshake: newHandshake,
+		fingerprint:  c.usedTLSCtx.Fingerprint,
+		ntorKey:      ntorKey,
+		resultQueue:  c.onionskinResults,
 	}
+	copy(job.data, data)
 
-	secr, err := dh.GetSharedKey(theirData)
-	if err != nil {
-		return RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	if !c.parentOR.onionskins.Submit(job) {
+		ReturnCellBuf(job.data)
+		return RefuseCircuit(errors.New("onionskin queue is full"), DESTROY_REASON_RESOURCELIMIT)
 	}
 
-	keyData := KDFTOR(92, secr)
-
-	cmd := CMD_CREATED2
-	if !newHandshake {
-		cmd = CMD_CREATED
-	}
-	writeCell := NewCell(c.negotiatedVersion, id, cmd, nil)
-	buf := writeCell.Data()
+	c.pendingCreates[circID] = job
+	c.onionskinsInFlight++
+	return nil
+}
 
-	if !newHandshake {
-		copy(buf[0:128], pub)
-		copy(buf[128:148], keyData[0:20])
-	} else {
-		buf[0] = 0
-		buf[1] = 148
-		copy(buf[2:130], pub)
-		copy(buf[130:150], keyData[0:20])
+func (c *OnionConnection) handleCreateTAP(id CircuitID, data []byte, newHandshake bool) ActionableError {
+	if len(data) < 186 {
+		return RefuseCircuit(errors.New("didn't get enough data"), DESTROY_REASON_PROTOCOL)
 	}
 
-	circ := NewCircuit(id, keyData[20:40], keyData[40:60], keyData[60:76], keyData[76:92])
-	c.circuits[id] = circ
-
-	c.writeQueue <- writeCell.Bytes()
-	return nil
+	return c.queueOnionskin(id, HANDSHAKE_TAP, data[0:186], newHandshake, nil)
 }
 
 func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHandshake bool) ActionableError {
@@ -180,11 +190,6 @@ func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHan
 		return RefuseCircuit(errors.New("didn't get enough data"), DESTROY_REASON_PROTOCOL)
 	}
 
-	_, alreadyThere := c.circuits[circID]
-	if alreadyThere {
-		return CloseConnection(errors.New("nope"))
-	}
-
 	fingerprint := data[0:20]
 	myFingerprint := c.usedTLSCtx.Fingerprint
 	for i, v := range fingerprint {
@@ -194,6 +199,73 @@ func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHan
 		}
 	}
 
+	// We may have rotated our keys since the client got our descriptor
+	key := c.parentOR.ntorKeyByID(data[20:52])
+	if key == nil {
+		return RefuseCircuit(errors.New("onionskin for an unknown ntor key"), DESTROY_REASON_PROTOCOL)
+	}
+
+	return c.queueOnionskin(circID, HANDSHAKE_NTOR, data[0:84], newHandshake, key)
+}
+
+func (c *OnionConnection) handleCreateNTOR3(circID CircuitID, data []byte) ActionableError {
+	if len(data) < NTOR3_CLIENT_OVERHEAD {
+		return RefuseCircuit(errors.New("didn't get enough data"), DESTROY_REASON_PROTOCOL)
+	}
+
+	key := c.parentOR.ntorKeyByID(data[32:64])
+	if key == nil {
+		return RefuseCircuit(errors.New("onionskin for an unknown ntor key"), DESTROY_REASON_PROTOCOL)
+	}
+
+	return c.queueOnionskin(circID, HANDSHAKE_NTOR3, data, true, key)
+}
+
+// The functions below run on the onionskin workers. They return the handshake reply and 72 bytes of key
+// material: forward digest seed, backward digest seed, forward key and backward key.
+
+func (or *ORCtx) onionskinTAP(data []byte) ([]byte, []byte, ActionableError) {
+	var theirData []byte
+	err := errors.New("we have no TAP onion key")
+	for _, key := range or.tapKeys() {
+		theirData, err = HybridDecrypt(key, data[0:186])
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	}
+
+	if len(theirData) != 128 {
+		return nil, nil, RefuseCircuit(errors.New("invalid TAP handshake found"), DESTROY_REASON_INTERNAL)
+	}
+
+	dh, err := openssl.LoadDHFromBignumWithGenerator(dhKey, 2)
+	if err != nil {
+		return nil, nil, RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	}
+
+	pub, err := dh.GetPublicKey()
+	if err != nil {
+		return nil, nil, RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	}
+
+	secr, err := dh.GetSharedKey(theirData)
+	if err != nil {
+		return nil, nil, RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	}
+
+	keyData := KDFTOR(92, secr)
+
+	reply := make([]byte, 148)
+	copy(reply[0:128], pub)
+	copy(reply[128:148], keyData[0:20])
+
+	return reply, keyData[20:92], nil
+}
+
+func (or *ORCtx) onionskinNTOR(fingerprint Fingerprint, key *ntorKeyPair, data []byte) ([]byte, []byte, ActionableError) {
 	var key_X [32]byte
 	copy(key_X[:], data[52:84])
 
@@ -216,11 +288,11 @@ func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHan
 	curve25519.ScalarMult(&tmpHolder, &key_y, &key_X)
 	buffer.Write(tmpHolder[:])
 
-	curve25519.ScalarMult(&tmpHolder, &c.parentOR.ntorPrivate, &key_X)
+	curve25519.ScalarMult(&tmpHolder, &key.private, &key_X)
 	buffer.Write(tmpHolder[:])
 
-	buffer.Write(fingerprint)
-	buffer.Write(c.parentOR.ntorPublic[:])
+	buffer.Write(fingerprint[:])
+	buffer.Write(key.public[:])
 	buffer.Write(key_X[:])
 	buffer.Write(key_Y[:])
 	buffer.Write([]byte("ntor-curve25519-sha256-1"))
@@ -234,8 +306,8 @@ func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHan
 
 	buffer.Reset()
 	buffer.Write(verify)
-	buffer.Write(fingerprint)
-	buffer.Write(c.parentOR.ntorPublic[:])
+	buffer.Write(fingerprint[:])
+	buffer.Write(key.public[:])
 	buffer.Write(key_Y[:])
 	buffer.Write(key_X[:])
 	buffer.Write([]byte("ntor-curve25519-sha256-1Server"))
@@ -247,26 +319,52 @@ func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHan
 
 	// XXX check for infinity
 
+	reply := make([]byte, 64)
+	copy(reply[0:32], key_Y[:])
+	copy(reply[32:64], auth)
+
+	return reply, kdf, nil
+}
+
+func (data *OnionskinResult) Handle(c *OnionConnection) ActionableError {
+	c.onionskinsInFlight--
+	if c.pendingCreates[data.id] != data.job {
+		// They destroyed the circuit, and possibly reused the ID, while we were busy
+		Log(LOG_INFO, "Dropping onionskin result for circuit %d: it is gone", data.id)
+		return nil
+	}
+	delete(c.pendingCreates, data.id)
+
+	if data.err != nil {
+		Log(LOG_INFO, "Refusing circuit %d: %s", data.id, data.err)
+		c.queueWrite(NewCell(c.negotiatedVersion, data.id, CMD_DESTROY, []byte{byte(data.err.CircDestroyReason())}).Bytes())
+		return nil
+	}
+
 	cmd := CMD_CREATED2
-	if !newHandshake {
+	if !data.newHandshake {
 		cmd = CMD_CREATED
 	}
-	writeCell := NewCell(c.negotiatedVersion, circID, cmd, nil)
-	writeCellBuf := writeCell.Data()
-	if newHandshake {
-		writeCellBuf[0] = 0
-		writeCellBuf[1] = 64
-		copy(writeCellBuf[2:34], key_Y[:])
-		copy(writeCellBuf[34:], auth)
+	writeCell := NewCell(c.negotiatedVersion, data.id, cmd, nil)
+	buf := writeCell.Data()
+	if data.newHandshake {
+		BigEndian.PutUint16(buf[0:2], uint16(len(data.reply)))
+		copy(buf[2:], data.reply)
 	} else {
-		copy(writeCellBuf[0:32], key_Y[:])
-		copy(writeCellBuf[32:], auth)
+		copy(buf, data.reply)
 	}
 
-	circ := NewCircuit(circID, kdf[0:20], kdf[20:40], kdf[40:56], kdf[56:72])
-	c.circuits[circID] = circ
+	keys := data.keys
+	circ := NewCircuit(data.id, keys[0:20], keys[20:40], keys[40:56], keys[56:72])
+	circ.queue = c.parentOR.NewQueueAccount(c.circuitReadQueue, data.id, false)
+	circ.cells = c.scheduler.NewQueue(circ.queue)
+	if data.params.cc != nil {
+		circ.cc = data.params.cc
+		circ.backwardWindow = NewWindow(data.params.cc.cwnd)
+	}
+	c.circuits[data.id] = circ
 
-	c.writeQueue <- writeCell.Bytes()
+	c.queueWrite(writeCell.Bytes())
 
 	return nil
 }
@@ -28,7 +28,7 @@ func (data *CircuitDestroyed) Handle(c *OnionConnection, circ *Circuit) Actionab
 		return c.sendRelayCell(circ, 0, BackwardDirection, RELAY_TRUNCATED, []byte{byte(data.reason)})
 	} else {
 		c.destroyCircuit(circ, false, true, data.reason)
-		c.writeQueue <- NewCell(c.negotiatedVersion, circ.id, CMD_DESTROY, []byte{byte(data.reason)}).Bytes()
+		c.queueWrite(NewCell(c.negotiatedVersion, circ.id, CMD_DESTROY, []byte{byte(data.reason)}).Bytes())
 		return nil
 	}
 }
@@ -37,7 +37,7 @@ func (data *CircuitDestroyed) HandleRelay(c *OnionConnection, circ *RelayCircuit
 	Log(LOG_CIRC, "CircuitDestroy (relay)")
 	c.destroyRelayCircuit(circ, false, true, data.reason)
 
-	c.writeQueue <- NewCell(c.negotiatedVersion, circ.id, CMD_DESTROY, []byte{byte(data.reason)}).Bytes()
+	c.queueWrite(NewCell(c.negotiatedVersion, circ.id, CMD_DESTROY, []byte{byte(data.reason)}).Bytes())
 	return nil
 }
 
@@ -47,7 +47,10 @@ func (c *OnionConnection) handleDestroy(cell Cell) ActionableError {
 	circID := cell.CircID()
 	if circID.MSB(c.negotiatedVersion) != c.isOutbound {
 		circ, ok := c.circuits[circID]
-		if !ok {
+		if _, pending := c.pendingCreates[circID]; pending {
+			// The onionskin result will be dropped when it arrives
+			delete(c.pendingCreates, circID)
+		} else if !ok {
 			Log(LOG_INFO, "Got a DESTROY but we don't know the circuit they're talking about. Ignoring")
 		} else {
 			c.destroyCircuit(circ, true, true, DestroyReason(cell.Data()[0]))
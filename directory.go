@@ -0,0 +1,142 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The directory documents we serve: our own descriptor and extra-info. Both the DirPort and BEGIN_DIR streams
+// go through this handler. Everything else goes to the fallback, if there is one.
+type dirDocuments struct {
+	lock                  sync.RWMutex
+	fingerprint           string
+	descriptor, extraInfo string
+
+	fallback http.Handler
+}
+
+// When the DirPort is served by someone else, the requests we can't answer go there
+func dirPortFallback(config *Config) http.Handler {
+	if config.DirPort == 0 || config.ServeDirPort {
+		return nil
+	}
+	return httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("127.0.0.1:%d", config.DirPort),
+	})
+}
+
+func (d *dirDocuments) Set(fingerprint, descriptor, extraInfo string) {
+	d.lock.Lock()
+	d.fingerprint = fingerprint
+	d.descriptor = descriptor
+	d.extraInfo = extraInfo
+	d.lock.Unlock()
+}
+
+func (d *dirDocuments) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// A .z suffix asks for the document to be deflated
+	path := r.URL.Path
+	compress := strings.HasSuffix(path, ".z")
+	path = strings.TrimSuffix(path, ".z")
+
+	d.lock.RLock()
+	var doc string
+	switch path {
+	case "/tor/server/authority", "/tor/server/fp/" + d.fingerprint:
+		doc = d.descriptor
+	case "/tor/extra/authority", "/tor/extra/fp/" + d.fingerprint:
+		doc = d.extraInfo
+	}
+	d.lock.RUnlock()
+
+	if doc == "" || (r.Method != "GET" && r.Method != "HEAD") {
+		if d.fallback != nil {
+			d.fallback.ServeHTTP(w, r)
+		} else if doc == "" {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method == "HEAD" {
+		return
+	}
+	if compress {
+		zw := zlib.NewWriter(w)
+		zw.Write([]byte(doc))
+		zw.Close()
+	} else {
+		w.Write([]byte(doc))
+	}
+}
+
+// Serves the directory over the DirPort, if that's our job
+func (or *ORCtx) ServeDirPort() {
+	if or.config.DirPort == 0 || !or.config.ServeDirPort {
+		return
+	}
+	Log(LOG_WARN, "DirPort: %s", http.ListenAndServe(fmt.Sprintf(":%d", or.config.DirPort), &or.directory))
+}
+
+// A listener that hands out a single connection, so that net/http can serve a BEGIN_DIR stream
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+var errListenerDone = errors.New("listener is done")
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, errListenerDone
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Returns a connection to an in-process HTTP server for the directory handler
+func serveDirectoryConn(handler http.Handler) net.Conn {
+	client, server := net.Pipe()
+
+	l := &singleConnListener{conn: server, done: make(chan struct{})}
+	var closeOnce sync.Once
+	srv := &http.Server{
+		Handler: handler,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				closeOnce.Do(func() { close(l.done) })
+			}
+		},
+	}
+	go srv.Serve(l)
+
+	return client
+}
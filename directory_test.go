@@ -0,0 +1,78 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestDirectoryConn(t *testing.T) {
+	var docs dirDocuments
+	docs.Set("AAAA", "router test\n", "extra-info test\n")
+
+	for path, expected := range map[string]string{
+		"/tor/server/authority": "router test\n",
+		"/tor/extra/fp/AAAA.z":  "extra-info test\n",
+		"/tor/server/fp/BBBB":   "",
+	} {
+		conn := serveDirectoryConn(&docs)
+		conn.Write([]byte("GET " + path + " HTTP/1.0\r\n\r\n"))
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == "" {
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%s: expected a 404, got %d", path, resp.StatusCode)
+			}
+			conn.Close()
+			continue
+		}
+
+		body := resp.Body
+		if path[len(path)-2:] == ".z" {
+			if body, err = zlib.NewReader(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil || string(data) != expected {
+			t.Errorf("%s: got %q, %v", path, data, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestDirectoryFallback(t *testing.T) {
+	if dirPortFallback(&Config{DirPort: 9030, ServeDirPort: true}) != nil {
+		t.Error("fallback to a DirPort we serve ourselves")
+	}
+	if dirPortFallback(&Config{}) != nil {
+		t.Error("fallback without a DirPort")
+	}
+
+	docs := dirDocuments{fallback: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fallback " + r.URL.Path))
+	})}
+	docs.Set("AAAA", "router test\n", "extra-info test\n")
+
+	conn := serveDirectoryConn(&docs)
+	defer conn.Close()
+	conn.Write([]byte("GET /tor/status-vote/current/consensus HTTP/1.0\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(data) != "fallback /tor/status-vote/current/consensus" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
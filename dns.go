@@ -6,7 +6,7 @@ package main
 
 import (
 	"net"
-	"github.com/miekg/dns"
+	"strings"
 )
 
 type DNSAddress struct {
@@ -33,15 +33,15 @@ func (da DNSAddress) String() string {
 		return net.IPv4(da.Value[0], da.Value[1], da.Value[2], da.Value[3]).String()
 	} else if da.Type == 6 {
 		return "[" + net.IP(da.Value).String() + "]"
+	} else if da.Type == DNS_ANSWER_HOSTNAME {
+		return string(da.Value)
 	} else {
 		return "error"
 	}
 }
 
-var dnsClient = new(dns.Client)
-var config, _ = dns.ClientConfigFromFile("/etc/resolv.conf")
-
-func ResolveDNS(host string) []DNSAddress {
+// Looks up the A and/or AAAA records of a host. IP addresses are returned as-is.
+func ResolveDNS(host string, ipv4, ipv6 bool) []DNSAddress {
 	parsedIP := net.ParseIP(host)
 	if parsedIP != nil {
 		v := parsedIP.To16()
@@ -59,39 +59,23 @@ func ResolveDNS(host string) []DNSAddress {
 		}
 	}
 
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(host), dns.TypeA) //XXX will this stop us from getting AAAA?
-	in, _, err := dnsClient.Exchange(m, config.Servers[0]+":"+config.Port)
-	if err != nil {
-		return []DNSAddress{DNSAddress{0xF0, 0, nil}}
-	}
+	return getResolver().Lookup(host, ipv4, ipv6)
+}
 
-	var r []DNSAddress
-	for _, answer := range in.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			r = append(r, DNSAddress{
-				Value: []byte(a.A.To4()),
-				Type: 4,
-				TTL: int(a.Hdr.Ttl),
-			})
-		}
-		if aaaa, ok := answer.(*dns.AAAA); ok {
-			r = append(r, DNSAddress{
-				Value: []byte(aaaa.AAAA.To16()),
-				Type: 6,
-				TTL: int(aaaa.Hdr.Ttl),
-			})
-		}
-	}
-	if len(r) == 0 {
-		return []DNSAddress{DNSAddress{0xF1, 0, nil}}
-	}
-	return r
+// Clients ask for reverse lookups (RESOLVE_PTR) by sending these names
+func isReverseName(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.HasSuffix(host, ".in-addr.arpa") || strings.HasSuffix(host, ".ip6.arpa")
 }
 
-func ResolveDNSAsync(host string, circ CircuitID, stream StreamID, resultChan CircReadQueue) {
-	go func() { // XXX this can be a lot faster and we really don't need a goroutine for each.
-		result := ResolveDNS(host)
+func ResolveDNSAsync(host string, ipv6 bool, circ CircuitID, stream StreamID, resultChan CircReadQueue) {
+	go func() { // Cheap enough, identical lookups are coalesced by the resolver
+		var result []DNSAddress
+		if isReverseName(host) {
+			result = getResolver().LookupPTR(host)
+		} else {
+			result = ResolveDNS(host, true, ipv6)
+		}
 		resultChan <- &DNSResult{
 			circuitID: circ,
 			streamID:  stream,
@@ -105,7 +89,7 @@ func (dr *DNSResult) Handle(c *OnionConnection, circ *Circuit) ActionableError {
 	pos := 0
 	for _, item := range dr.Results {
 		if len(item.Value) > 255 {
-			panic("Huh? I thought we're talking IP addresses")
+			continue // A hostname that doesn't fit the length byte
 		}
 		if len(buf)-pos-6-len(item.Value) < 0 {
 			break
@@ -114,7 +98,7 @@ func (dr *DNSResult) Handle(c *OnionConnection, circ *Circuit) ActionableError {
 		buf[pos+1] = byte(len(item.Value))
 		copy(buf[pos+2:], []byte(item.Value))
 		pos += 2 + len(item.Value)
-		BigEndian.PutUint32(buf[pos:pos+4], uint32(item.TTL))
+		BigEndian.PutUint32(buf[pos:pos+4], clipDNSTTL(item.TTL))
 		pos += 4
 	}
 
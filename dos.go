@@ -0,0 +1,135 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Mirrors the DoS mitigations in Tor's dos.c. Only connections from clients (peers that did not authenticate
+// as a relay) are subject to these limits.
+
+type dosClientStats struct {
+	concurrentConns int
+
+	createTokens     int
+	lastCreateRefill time.Time
+	markedUntil      time.Time
+}
+
+func dosClientAddress(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (or *ORCtx) dosClient(addr string) *dosClientStats {
+	stats, ok := or.dosClients[addr]
+	if !ok {
+		stats = &dosClientStats{
+			createTokens:     or.config.DoSCircuitCreationBurst,
+			lastCreateRefill: time.Now(),
+		}
+		or.dosClients[addr] = stats
+	}
+	return stats
+}
+
+// Registers a new client connection. Returns false if the connection should be closed.
+func (or *ORCtx) DoSConnectionOpened(addr string) bool {
+	or.dosLock.Lock()
+	defer or.dosLock.Unlock()
+
+	stats := or.dosClient(addr)
+	if or.config.DoSConnectionEnabled && stats.concurrentConns >= or.config.DoSConnectionMaxConcurrentCount {
+		StatsUpd(STATCTR_DOS_CONN_REJECTED, 1)
+		return false
+	}
+
+	stats.concurrentConns++
+	return true
+}
+
+func (or *ORCtx) DoSConnectionClosed(addr string) {
+	or.dosLock.Lock()
+	defer or.dosLock.Unlock()
+
+	stats, ok := or.dosClients[addr]
+	if !ok {
+		return
+	}
+
+	stats.concurrentConns--
+	if stats.concurrentConns <= 0 && time.Now().After(stats.markedUntil) {
+		delete(or.dosClients, addr)
+	}
+}
+
+// Decides whether a client may create another circuit, and marks it if it exceeded its budget
+func (or *ORCtx) DoSCreateAllowed(addr string) bool {
+	if !or.config.DoSCircuitCreationEnabled {
+		return true
+	}
+
+	or.dosLock.Lock()
+	defer or.dosLock.Unlock()
+
+	stats := or.dosClient(addr)
+	now := time.Now()
+
+	if now.Before(stats.markedUntil) {
+		StatsUpd(STATCTR_DOS_CIRC_REFUSED, 1)
+		return false
+	}
+
+	// Refill the bucket
+	elapsed := int(now.Sub(stats.lastCreateRefill) / time.Second)
+	if elapsed > 0 {
+		refill := elapsed * or.config.DoSCircuitCreationRate
+		if refill < 0 || stats.createTokens+refill > or.config.DoSCircuitCreationBurst {
+			stats.createTokens = or.config.DoSCircuitCreationBurst
+		} else {
+			stats.createTokens += refill
+		}
+		stats.lastCreateRefill = stats.lastCreateRefill.Add(time.Duration(elapsed) * time.Second)
+	}
+
+	if stats.createTokens > 0 {
+		stats.createTokens--
+		return true
+	}
+
+	if stats.concurrentConns >= or.config.DoSCircuitCreationMinConnections {
+		// Like Tor, add some randomness so that marked clients don't all come back at the same time
+		period := or.config.DoSCircuitCreationDefenseTimePeriod
+		if period > 0 {
+			period += time.Duration(rand.Int63n(int64(period)/2 + 1))
+		}
+		stats.markedUntil = now.Add(period)
+
+		StatsUpd(STATCTR_DOS_CLIENTS_MARKED, 1)
+		Log(LOG_NOTICE, "Marking client %s for circuit creation abuse", addr)
+		return false
+	}
+
+	return true
+}
+
+// Forgets clients that no longer hold connections and whose defense period expired
+func (or *ORCtx) DoSPrune() {
+	or.dosLock.Lock()
+	defer or.dosLock.Unlock()
+
+	now := time.Now()
+	for addr, stats := range or.dosClients {
+		if stats.concurrentConns <= 0 && now.After(stats.markedUntil) {
+			delete(or.dosClients, addr)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDoSCreateAllowed(t *testing.T) {
+	or := &ORCtx{dosClients: make(map[string]*dosClientStats), config: &Config{
+		DoSCircuitCreationEnabled:           true,
+		DoSCircuitCreationBurst:             2,
+		DoSCircuitCreationMinConnections:    1,
+		DoSCircuitCreationDefenseTimePeriod: time.Hour,
+	}}
+	if !or.DoSConnectionOpened("192.0.2.1") {
+		t.Fatal("connection refused")
+	}
+
+	for i := 0; i < 2; i++ {
+		if !or.DoSCreateAllowed("192.0.2.1") {
+			t.Fatalf("create %d refused with tokens left", i+1)
+		}
+	}
+	if or.DoSCreateAllowed("192.0.2.1") {
+		t.Fatal("create allowed with an empty bucket")
+	}
+	if or.DoSCreateAllowed("192.0.2.1") {
+		t.Fatal("marked client allowed to create")
+	}
+}
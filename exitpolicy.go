@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"strings"
 )
 
 type ExitRule struct {
@@ -24,6 +25,9 @@ type ExitPolicy struct {
 
 func (ep *ExitPolicy) AllowsConnect(addr []byte, port uint16) bool {
 	for _, rule := range ep.Rules {
+		if rule.V6 && len(addr) != 16 { // accept6 and reject6 only apply to IPv6
+			continue
+		}
 		if rule.Port == port || rule.Port == 0 { // "<something>:port" or "<something>:*"
 			if rule.Address == nil { // "*:port" or "*:*"
 				return rule.Action
@@ -47,6 +51,31 @@ func (ep *ExitPolicy) AllowsConnect(addr []byte, port uint16) bool {
 	return ep.DefaultAction
 }
 
+// The policy for IPv6 addresses in the summarized form of the ipv6-policy descriptor line, such as "accept 80,443"
+func (ep *ExitPolicy) DescribeIPv6() string {
+	var ranges []string
+	anyAddr := make([]byte, 16)
+	for port := 1; port <= 65535; port++ {
+		if !ep.AllowsConnect(anyAddr, uint16(port)) {
+			continue
+		}
+		start := port
+		for port < 65535 && ep.AllowsConnect(anyAddr, uint16(port+1)) {
+			port++
+		}
+		if start == port {
+			ranges = append(ranges, fmt.Sprintf("%d", port))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, port))
+		}
+	}
+
+	if len(ranges) == 0 {
+		return "reject 1-65535"
+	}
+	return "accept " + strings.Join(ranges, ",")
+}
+
 func (ep *ExitPolicy) Describe() (string, error) {
 	var buf bytes.Buffer
 	var v6buf bytes.Buffer
@@ -0,0 +1,57 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestExitPolicyIPv6(t *testing.T) {
+	ep := ExitPolicy{Rules: []ExitRule{
+		{Port: 25, Action: false},
+		{Port: 443, Action: true, V6: true},
+		{Port: 80, Action: true},
+	}}
+
+	v4 := []byte{1, 2, 3, 4}
+	v6 := make([]byte, 16)
+	if ep.AllowsConnect(v4, 443) {
+		t.Error("accept6 rule applied to IPv4")
+	}
+	if !ep.AllowsConnect(v6, 443) || !ep.AllowsConnect(v6, 80) || ep.AllowsConnect(v6, 25) {
+		t.Error("IPv6 policy does not match")
+	}
+
+	if s := ep.DescribeIPv6(); s != "accept 80,443" {
+		t.Errorf("got ipv6-policy %q", s)
+	}
+	ep.Rules = append(ep.Rules, ExitRule{Action: true})
+	if s := ep.DescribeIPv6(); s != "accept 1-24,26-65535" {
+		t.Errorf("got ipv6-policy %q", s)
+	}
+}
+
+func TestSelectAddress(t *testing.T) {
+	results := []DNSAddress{
+		{Type: 4, Value: []byte{1, 2, 3, 4}},
+		{Type: 6, Value: make([]byte, 16)},
+	}
+
+	if a, ok := selectAddress(results, 0); !ok || a.Type != 4 {
+		t.Error("expected IPv4 without flags")
+	}
+	if a, ok := selectAddress(results, BEGIN_FLAG_IPV6_OK); !ok || a.Type != 4 {
+		t.Error("expected IPv4 when IPv6 is merely allowed")
+	}
+	if a, ok := selectAddress(results, BEGIN_FLAG_IPV6_OK|BEGIN_FLAG_IPV6_PREFERRED); !ok || a.Type != 6 {
+		t.Error("expected IPv6 when preferred")
+	}
+	if a, ok := selectAddress(results, BEGIN_FLAG_IPV6_OK|BEGIN_FLAG_IPV4_NOT_OK); !ok || a.Type != 6 {
+		t.Error("expected IPv6 when IPv4 is not ok")
+	}
+	if _, ok := selectAddress(results[1:], 0); ok {
+		t.Error("IPv6 used without IPV6_OK")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Exit port statistics for the extra-info descriptor, collected and rounded the way Tor does it
+const (
+	EXIT_STATS_INTERVAL         = 24 * time.Hour
+	EXIT_STATS_TOP_N_PORTS      = 10
+	EXIT_STATS_ROUND_UP_BYTES   = 1024
+	EXIT_STATS_ROUND_UP_STREAMS = 4
+)
+
+type exitPortStats struct {
+	read, written uint64
+	streams       uint64
+}
+
+type ExitStats struct {
+	lock  sync.Mutex
+	start time.Time
+	ports map[uint16]*exitPortStats
+
+	// The last interval that finished, ready for the descriptor
+	published string
+}
+
+var exitStats = NewExitStats(time.Now())
+
+func NewExitStats(now time.Time) *ExitStats {
+	return &ExitStats{
+		start: now,
+		ports: make(map[uint16]*exitPortStats),
+	}
+}
+
+// Must be called with the lock held
+func (es *ExitStats) port(port uint16, now time.Time) *exitPortStats {
+	es.maybeRotate(now)
+	p, ok := es.ports[port]
+	if !ok {
+		p = &exitPortStats{}
+		es.ports[port] = p
+	}
+	return p
+}
+
+func (es *ExitStats) NoteStreamOpened(port uint16) {
+	es.lock.Lock()
+	es.port(port, time.Now()).streams++
+	es.lock.Unlock()
+}
+
+// Bytes we read from and wrote to an exit connection
+func (es *ExitStats) NoteBytes(port uint16, read, written uint64) {
+	if read == 0 && written == 0 {
+		return
+	}
+	es.lock.Lock()
+	p := es.port(port, time.Now())
+	p.read += read
+	p.written += written
+	es.lock.Unlock()
+}
+
+// The lines for the extra-info descriptor, or "" if no interval has finished yet
+func (es *ExitStats) Describe(now time.Time) string {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	es.maybeRotate(now)
+	return es.published
+}
+
+// Must be called with the lock held
+func (es *ExitStats) maybeRotate(now time.Time) {
+	if now.Sub(es.start) < EXIT_STATS_INTERVAL {
+		return
+	}
+
+	end := es.start.Add(EXIT_STATS_INTERVAL)
+	es.published = formatExitStats(es.ports, end)
+	es.ports = make(map[uint16]*exitPortStats)
+	es.start = end
+	if now.Sub(es.start) >= EXIT_STATS_INTERVAL {
+		// We didn't hear anything for a while
+		es.start = now
+	}
+}
+
+func roundUp(val, multiple uint64) uint64 {
+	return (val + multiple - 1) / multiple * multiple
+}
+
+func formatExitStats(ports map[uint16]*exitPortStats, end time.Time) string {
+	// The ports with the most traffic get listed, the rest is summed up as "other"
+	var top []uint16
+	for port, p := range ports {
+		if p.read+p.written != 0 {
+			top = append(top, port)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		a, b := ports[top[i]], ports[top[j]]
+		if a.read+a.written != b.read+b.written {
+			return a.read+a.written > b.read+b.written
+		}
+		return top[i] < top[j]
+	})
+	if len(top) > EXIT_STATS_TOP_N_PORTS {
+		top = top[:EXIT_STATS_TOP_N_PORTS]
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i] < top[j] })
+
+	var other exitPortStats
+	for _, p := range ports {
+		other.read += p.read
+		other.written += p.written
+		other.streams += p.streams
+	}
+
+	var written, read, streams bytes.Buffer
+	for _, port := range top {
+		p := ports[port]
+		other.read -= p.read
+		other.written -= p.written
+		other.streams -= p.streams
+
+		// Like Tor, each line only lists the ports that have something to show for it
+		if p.written != 0 {
+			fmt.Fprintf(&written, "%d=%d,", port, roundUp(p.written, EXIT_STATS_ROUND_UP_BYTES)>>10)
+		}
+		if p.read != 0 {
+			fmt.Fprintf(&read, "%d=%d,", port, roundUp(p.read, EXIT_STATS_ROUND_UP_BYTES)>>10)
+		}
+		if p.streams != 0 {
+			fmt.Fprintf(&streams, "%d=%d,", port, roundUp(p.streams, EXIT_STATS_ROUND_UP_STREAMS))
+		}
+	}
+	fmt.Fprintf(&written, "other=%d", roundUp(other.written, EXIT_STATS_ROUND_UP_BYTES)>>10)
+	fmt.Fprintf(&read, "other=%d", roundUp(other.read, EXIT_STATS_ROUND_UP_BYTES)>>10)
+	fmt.Fprintf(&streams, "other=%d", roundUp(other.streams, EXIT_STATS_ROUND_UP_STREAMS))
+
+	return fmt.Sprintf("exit-stats-end %s (%d s)\nexit-kibibytes-written %s\nexit-kibibytes-read %s\nexit-streams-opened %s\n",
+		end.UTC().Format("2006-01-02 15:04:05"), int(EXIT_STATS_INTERVAL/time.Second),
+		written.String(), read.String(), streams.String())
+}
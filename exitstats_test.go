@@ -0,0 +1,39 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExitStats(t *testing.T) {
+	start := time.Now()
+	es := NewExitStats(start)
+
+	// Twelve ports, so the two quietest end up in "other". Nothing was written to port 12
+	for port := uint16(1); port <= 12; port++ {
+		es.NoteStreamOpened(port)
+		if port == 12 {
+			es.NoteBytes(port, uint64(port)*1000, 0)
+		} else {
+			es.NoteBytes(port, uint64(port)*1000, 1)
+		}
+	}
+	es.NoteStreamOpened(443)
+
+	if s := es.Describe(start.Add(time.Hour)); s != "" {
+		t.Errorf("published stats before the interval ended: %q", s)
+	}
+
+	end := start.Add(24 * time.Hour).UTC().Format("2006-01-02 15:04:05")
+	expected := "exit-stats-end " + end + " (86400 s)\n" +
+		"exit-kibibytes-written 3=1,4=1,5=1,6=1,7=1,8=1,9=1,10=1,11=1,other=1\n" +
+		"exit-kibibytes-read 3=3,4=4,5=5,6=6,7=7,8=8,9=9,10=10,11=11,12=12,other=3\n" +
+		"exit-streams-opened 3=4,4=4,5=4,6=4,7=4,8=4,9=4,10=4,11=4,12=4,other=4\n"
+	if s := es.Describe(start.Add(25 * time.Hour)); s != expected {
+		t.Errorf("got\n%s\nexpected\n%s", s, expected)
+	}
+}
@@ -6,10 +6,11 @@ package main
 
 import (
 	"errors"
+	"time"
 )
 
-func (c *OnionConnection) handleRelayExtend(circ *Circuit, cell *RelayCell) ActionableError {
-	data := cell.Data()
+func (c *OnionConnection) handleRelayExtend(circ *Circuit, msg *RelayMessage) ActionableError {
+	data := msg.Data()
 
 	Log(LOG_CIRC, "Got extend!")
 
@@ -53,6 +54,7 @@ func (c *OnionConnection) handleRelayExtend(circ *Circuit, cell *RelayCell) Acti
 	circReq.handshakeState = &CircuitHandshakeState{}
 
 	circ.extendState = circReq.handshakeState
+	circ.extendStarted = time.Now()
 
 	if err := c.parentOR.RequestCircuit(circReq); err != nil {
 		return CloseCircuit(err, DESTROY_REASON_INTERNAL)
@@ -61,10 +63,10 @@ func (c *OnionConnection) handleRelayExtend(circ *Circuit, cell *RelayCell) Acti
 	return nil
 }
 
-func (c *OnionConnection) handleRelayExtend2(circ *Circuit, cell *RelayCell) ActionableError {
+func (c *OnionConnection) handleRelayExtend2(circ *Circuit, msg *RelayMessage) ActionableError {
 	Log(LOG_CIRC, "got extend")
 
-	data := cell.Data()
+	data := msg.Data()
 	nspec := int(data[0])
 	if 1+(nspec*2)+4 > len(data) {
 		return CloseCircuit(errors.New("malformed EXTEND cell"), DESTROY_REASON_PROTOCOL)
@@ -142,6 +144,7 @@ func (c *OnionConnection) handleRelayExtend2(circ *Circuit, cell *RelayCell) Act
 	circReq.handshakeState = &CircuitHandshakeState{}
 
 	circ.extendState = circReq.handshakeState
+	circ.extendStarted = time.Now()
 
 	if err := c.parentOR.RequestCircuit(circReq); err != nil {
 		return CloseCircuit(err, DESTROY_REASON_INTERNAL)
@@ -210,7 +213,15 @@ func (data *CircuitCreated) Handle(c *OnionConnection, circ *Circuit) Actionable
 }
 
 func (req *CircuitRequest) Handle(c *OnionConnection, notreallyanthingatall *Circuit) ActionableError {
-	newID := c.NewCircID()
+	newID, err := c.NewCircID()
+	if err != nil {
+		Log(LOG_NOTICE, "Refusing to extend: %s", err)
+		req.successQueue <- &CircuitDestroyed{
+			id:     req.localID,
+			reason: DESTROY_REASON_RESOURCELIMIT,
+		}
+		return nil
+	}
 
 	req.handshakeState.lock.Lock()
 	aborted := req.handshakeState.aborted
@@ -240,13 +251,16 @@ func (req *CircuitRequest) Handle(c *OnionConnection, notreallyanthingatall *Cir
 	}
 
 	// XXX if they send data before the created2, it'll nicely work
-	c.relayCircuits[writeCell.CircID()] = &RelayCircuit{
+	rcirc := &RelayCircuit{
 		id:          writeCell.CircID(),
 		theirID:     req.localID,
 		previousHop: req.successQueue,
+		queue:       c.parentOR.NewQueueAccount(c.circuitReadQueue, writeCell.CircID(), true),
 	}
+	rcirc.cells = c.scheduler.NewQueue(rcirc.queue)
+	c.relayCircuits[writeCell.CircID()] = rcirc
 
-	c.writeQueue <- writeCell.Bytes()
+	c.queueWrite(writeCell.Bytes())
 
 	return nil
 }
@@ -87,7 +87,7 @@ func (c *OnionConnection) negotiateVersionServer(conn io.Reader) error {
 	writeCell[4] = 2
 	BigEndian.PutUint16(writeCell[5:7], uint16(c.negotiatedVersion))
 
-	c.writeQueue <- writeCell
+	c.queueWrite(writeCell)
 
 	return nil
 }
@@ -108,7 +108,7 @@ func (c *OnionConnection) negotiateVersionClient(conn io.Reader, readHash, write
 		i += 2
 	}
 	writeHash.Write(writeCell)
-	c.writeQueue <- writeCell
+	c.queueWrite(writeCell)
 
 	var head [5]byte
 	gotBytes := 0
@@ -189,7 +189,7 @@ func (c *OnionConnection) sendCerts(writeHash hash.Hash) error { // Now that we'
 	if writeHash != nil {
 		writeHash.Write(cell.Bytes())
 	}
-	c.writeQueue <- cell.Bytes()
+	c.queueWrite(cell.Bytes())
 
 	return nil
 }
@@ -219,7 +219,7 @@ func (c *OnionConnection) sendNetinfo(writeHash hash.Hash) error {
 	if writeHash != nil { // XXX
 		writeHash.Write(cell.Bytes())
 	}
-	c.writeQueue <- cell.Bytes()
+	c.queueWrite(cell.Bytes())
 
 	return nil
 }
@@ -236,7 +236,7 @@ func (c *OnionConnection) sendAuthChallenge() error {
 	buf.Write(challenge[:])
 	buf.Write([]byte{0, 1, 0, 1})
 
-	c.writeQueue <- buf.Bytes()
+	c.queueWrite(buf.Bytes())
 
 	return nil
 }
@@ -322,7 +322,7 @@ func (c *OnionConnection) handleAuthChallenge(cell Cell, hashInbound, hashOutbou
 	tmpdata := buf.Bytes()
 	BigEndian.PutUint16(tmpdata[2:4], uint16(len(tmpdata)-4))
 
-	c.writeQueue <- NewVarCell(c.negotiatedVersion, 0, CMD_AUTHENTICATE, tmpdata, 0).Bytes()
+	c.queueWrite(NewVarCell(c.negotiatedVersion, 0, CMD_AUTHENTICATE, tmpdata, 0).Bytes())
 
 	return nil
 }
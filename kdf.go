@@ -8,6 +8,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/binary"
+	"golang.org/x/crypto/sha3"
 )
 
 func KDFTOR(bytes int, random []byte) []byte {
@@ -64,3 +66,36 @@ func KDFHKDF(bytes int, secretInput, key, mExpand []byte) []byte {
 
 	return result[0:bytes]
 }
+
+// The SHA3 based primitives of ntor v3. Every variable-length input is prefixed with its 64-bit length
+func encap(s []byte) []byte {
+	out := make([]byte, 8+len(s))
+	binary.BigEndian.PutUint64(out[0:8], uint64(len(s)))
+	copy(out[8:], s)
+	return out
+}
+
+func H3(s, tweak []byte) []byte {
+	h := sha3.New256()
+	h.Write(encap(tweak))
+	h.Write(s)
+	return h.Sum(nil)
+}
+
+func MAC3(key, msg, tweak []byte) []byte {
+	h := sha3.New256()
+	h.Write(encap(tweak))
+	h.Write(encap(key))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+func KDFSHAKE(bytes int, s, tweak []byte) []byte {
+	h := sha3.NewShake256()
+	h.Write(encap(tweak))
+	h.Write(s)
+
+	result := make([]byte, bytes)
+	h.Read(result)
+	return result
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"expvar"
 	"github.com/tvdw/cgolock"
 	"log"
 	"net/http"
@@ -14,7 +15,6 @@ import (
 )
 
 import _ "net/http/pprof"
-import _ "expvar"
 
 func main() {
 	cgolock.Init(runtime.NumCPU())
@@ -28,6 +28,32 @@ func main() {
 		BandwidthAvg:      1073741824,
 		BandwidthBurst:    1073741824,
 		BandwidthObserved: 1 << 16,
+
+		CircuitExtendTimeout: 1 * time.Minute,
+
+		StreamConnectTimeout: 10 * time.Second,
+		StreamIdleTimeout:    30 * time.Minute,
+
+		MaxStreamsPerCircuit:    256,
+		MaxStreamsPerConnection: 4096,
+		MaxExitSockets:          16384,
+
+		CircuitPriorityHalflife: 30 * time.Second,
+		SendMeEmitMinVersion:    1,
+
+		CreateFastFromClientsOnly: true,
+
+		MaxOnionQueueDelay: 1750 * time.Millisecond,
+		MaxMemInQueues:     1 << 30,
+
+		// Tor's defaults
+		DoSCircuitCreationEnabled:           true,
+		DoSCircuitCreationMinConnections:    3,
+		DoSCircuitCreationRate:              3,
+		DoSCircuitCreationBurst:             90,
+		DoSCircuitCreationDefenseTimePeriod: 1 * time.Hour,
+		DoSConnectionEnabled:                true,
+		DoSConnectionMaxConcurrentCount:     50,
 	}
 	if err := torConfig.ReadFile(os.Args[1]); err != nil {
 		log.Panicln(err)
@@ -38,6 +64,10 @@ func main() {
 		log.Panicln(err)
 	}
 
+	expvar.Publish("onionskins", expvar.Func(func() interface{} {
+		return or.onionskins.Stats()
+	}))
+
 	/*
 		go func() {
 			or.RequestCircuit(&CircuitRequest{
@@ -57,23 +87,34 @@ func main() {
 	go func() {
 		Log(LOG_WARN, "%v", http.ListenAndServe("localhost:6060", nil))
 	}()
+	go or.ServeDirPort()
 
 	or.PublishDescriptor()
 
 	nextRotate := time.After(time.Hour * 1)
 	nextPublish := time.After(time.Hour * 18)
+	nextDoSPrune := time.After(time.Minute * 10)
 	for {
 		select {
 		case <-nextRotate: //XXX randomer intervals
 			if err := or.RotateKeys(); err != nil {
 				Log(LOG_WARN, "%v", err)
 			}
+			if rotated, err := or.MaybeRotateOnionKeys(); err != nil {
+				Log(LOG_WARN, "%v", err)
+			} else if rotated {
+				or.PublishDescriptor()
+			}
 			nextRotate = time.After(time.Hour * 1)
 
 		case <-nextPublish:
 			or.PublishDescriptor()
 			nextPublish = time.After(time.Hour * 18)
 
+		case <-nextDoSPrune:
+			or.DoSPrune()
+			nextDoSPrune = time.After(time.Minute * 10)
+
 		case <-anythingFinished:
 			log.Panicln("Somehow a main.go goroutine we spawned managed to finish, which is not good")
 		}
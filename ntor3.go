@@ -0,0 +1,233 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The ntor v3 handshake, which lets the client send us encrypted extensions and lets us reply with our own
+
+const (
+	NTOR3_PROTOID      = "ntor3-curve25519-sha3_256-1"
+	NTOR3_VERIFICATION = "circuit extend"
+
+	// The client part is ID | KEYID | X | MSG | MAC
+	NTOR3_CLIENT_OVERHEAD = 32 + 32 + 32 + 32
+)
+
+// Extension fields we understand, both in the client's message and in our reply
+const (
+	NTOR3_EXT_CC_REQUEST  = 1
+	NTOR3_EXT_CC_RESPONSE = 2
+	NTOR3_EXT_SUBPROTO    = 3
+)
+
+type ntor3Extension struct {
+	kind byte
+	data []byte
+}
+
+var (
+	ntor3TMsgKDF  = []byte(NTOR3_PROTOID + ":kdf_phase1")
+	ntor3TMsgMAC  = []byte(NTOR3_PROTOID + ":msg_mac")
+	ntor3TKeySeed = []byte(NTOR3_PROTOID + ":key_seed")
+	ntor3TVerify  = []byte(NTOR3_PROTOID + ":verify")
+	ntor3TFinal   = []byte(NTOR3_PROTOID + ":kdf_final")
+	ntor3TAuth    = []byte(NTOR3_PROTOID + ":auth_final")
+)
+
+// State between reading the client's onionskin and writing our reply
+type ntor3Server struct {
+	id, keyB, keyX [32]byte
+	keyb           [32]byte
+	verification   []byte
+	msgMAC         []byte
+	Message        []byte // The client's decrypted message
+}
+
+func ntor3Encrypt(key, msg []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(msg))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(out, msg)
+	return out
+}
+
+// Reads the client's onionskin, using our ntor private key b (whose public key is B)
+func ntor3ServerReceive(data []byte, keyb, keyB *[32]byte, verification []byte) (*ntor3Server, error) {
+	if len(data) < NTOR3_CLIENT_OVERHEAD {
+		return nil, errors.New("ntor3 onionskin too short")
+	}
+
+	st := &ntor3Server{keyb: *keyb, verification: verification}
+	copy(st.id[:], data[0:32])
+	copy(st.keyB[:], data[32:64])
+	copy(st.keyX[:], data[64:96])
+	encrypted := data[96 : len(data)-32]
+	mac := data[len(data)-32:]
+
+	if !bytes.Equal(st.keyB[:], keyB[:]) {
+		return nil, errors.New("ntor3 onionskin is not for our key")
+	}
+
+	var bx [32]byte
+	curve25519.ScalarMult(&bx, &st.keyb, &st.keyX)
+
+	var buffer bytes.Buffer
+	buffer.Write(bx[:])
+	buffer.Write(st.id[:])
+	buffer.Write(st.keyX[:])
+	buffer.Write(st.keyB[:])
+	buffer.Write([]byte(NTOR3_PROTOID))
+	buffer.Write(encap(verification))
+	phase1 := KDFSHAKE(64, buffer.Bytes(), ntor3TMsgKDF)
+	encKey, macKey := phase1[0:32], phase1[32:64]
+
+	buffer.Reset()
+	buffer.Write(st.id[:])
+	buffer.Write(st.keyB[:])
+	buffer.Write(st.keyX[:])
+	buffer.Write(encrypted)
+	st.msgMAC = MAC3(macKey, buffer.Bytes(), ntor3TMsgMAC)
+	if !hmac.Equal(st.msgMAC, mac) {
+		return nil, errors.New("ntor3 message MAC mismatch")
+	}
+
+	st.Message = ntor3Encrypt(encKey, encrypted)
+	return st, nil
+}
+
+// Builds our reply, using the ephemeral key y. Returns the reply and keyLen bytes of key material
+func (st *ntor3Server) Reply(keyy *[32]byte, message []byte, keyLen int) ([]byte, []byte, error) {
+	var keyY, xy, xb, zero [32]byte
+	curve25519.ScalarBaseMult(&keyY, keyy)
+	curve25519.ScalarMult(&xy, keyy, &st.keyX)
+	curve25519.ScalarMult(&xb, &st.keyb, &st.keyX)
+
+	// A low-order X gives the point at infinity, which would make the keys predictable
+	if subtle.ConstantTimeCompare(xy[:], zero[:])|subtle.ConstantTimeCompare(xb[:], zero[:]) == 1 {
+		return nil, nil, errors.New("ntor3 client key is a low-order point")
+	}
+
+	var buffer bytes.Buffer
+	buffer.Write(xy[:])
+	buffer.Write(xb[:])
+	buffer.Write(st.id[:])
+	buffer.Write(st.keyB[:])
+	buffer.Write(st.keyX[:])
+	buffer.Write(keyY[:])
+	buffer.Write([]byte(NTOR3_PROTOID))
+	buffer.Write(encap(st.verification))
+	secretInput := buffer.Bytes()
+
+	keySeed := H3(secretInput, ntor3TKeySeed)
+	verify := H3(secretInput, ntor3TVerify)
+	keystream := KDFSHAKE(32+keyLen, keySeed, ntor3TFinal)
+
+	encrypted := ntor3Encrypt(keystream[0:32], message)
+
+	buffer.Reset()
+	buffer.Write(verify)
+	buffer.Write(st.id[:])
+	buffer.Write(st.keyB[:])
+	buffer.Write(keyY[:])
+	buffer.Write(st.keyX[:])
+	buffer.Write(st.msgMAC)
+	buffer.Write(encap(encrypted))
+	buffer.Write([]byte(NTOR3_PROTOID))
+	buffer.Write([]byte("Server"))
+	auth := H3(buffer.Bytes(), ntor3TAuth)
+
+	reply := make([]byte, 0, 64+len(encrypted))
+	reply = append(reply, keyY[:]...)
+	reply = append(reply, auth...)
+	reply = append(reply, encrypted...)
+
+	return reply, keystream[32:], nil
+}
+
+func parseNtor3Extensions(msg []byte) ([]ntor3Extension, error) {
+	if len(msg) == 0 {
+		return nil, nil
+	}
+
+	count := int(msg[0])
+	msg = msg[1:]
+	exts := make([]ntor3Extension, 0, count)
+	for i := 0; i < count; i++ {
+		if len(msg) < 2 || len(msg) < 2+int(msg[1]) {
+			return nil, errors.New("truncated ntor3 extension")
+		}
+		exts = append(exts, ntor3Extension{msg[0], msg[2 : 2+int(msg[1])]})
+		msg = msg[2+int(msg[1]):]
+	}
+
+	return exts, nil
+}
+
+func encodeNtor3Extensions(exts []ntor3Extension) []byte {
+	msg := []byte{byte(len(exts))}
+	for _, ext := range exts {
+		msg = append(msg, ext.kind, byte(len(ext.data)))
+		msg = append(msg, ext.data...)
+	}
+	return msg
+}
+
+// What the client asked for in its ntor v3 extensions
+type circuitParams struct {
+	cc *CongestionControl
+}
+
+func (or *ORCtx) onionskinNTOR3(key *ntorKeyPair, data []byte) ([]byte, []byte, circuitParams, ActionableError) {
+	var params circuitParams
+
+	st, err := ntor3ServerReceive(data, &key.private, &key.public, []byte(NTOR3_VERIFICATION))
+	if err != nil {
+		return nil, nil, params, RefuseCircuit(err, DESTROY_REASON_PROTOCOL)
+	}
+
+	// XXX we have no Ed25519 identity yet, so we can't check that the ID they sent is ours
+
+	exts, err := parseNtor3Extensions(st.Message)
+	if err != nil {
+		return nil, nil, params, RefuseCircuit(err, DESTROY_REASON_PROTOCOL)
+	}
+
+	var replyExts []ntor3Extension
+	for _, ext := range exts {
+		switch ext.kind {
+		case NTOR3_EXT_CC_REQUEST:
+			params.cc = NewCongestionControl(CC_SENDME_INC)
+			replyExts = append(replyExts, ntor3Extension{NTOR3_EXT_CC_RESPONSE, []byte{CC_SENDME_INC}})
+		case NTOR3_EXT_SUBPROTO:
+			// None of the subprotocols that are negotiated this way are implemented
+			return nil, nil, params, RefuseCircuit(errors.New("unsupported subprotocol request"), DESTROY_REASON_PROTOCOL)
+		default:
+			// Unknown extensions are ignored
+		}
+	}
+
+	var keyy [32]byte
+	CRandBytes(keyy[:])
+	keyy[0] &= 248
+	keyy[31] &= 127
+	keyy[31] |= 64
+
+	reply, keys, err := st.Reply(&keyy, encodeNtor3Extensions(replyExts), 72)
+	if err != nil {
+		return nil, nil, params, RefuseCircuit(err, DESTROY_REASON_PROTOCOL)
+	}
+	return reply, keys, params, nil
+}
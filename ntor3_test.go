@@ -0,0 +1,77 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNtor3TestVectors(t *testing.T) {
+	// Test vectors from the ntor v3 specification
+	var keyb, keyB, keyy [32]byte
+	copy(keyb[:], mustHex(t, "4051daa5921cfa2a1c27b08451324919538e79e788a81b38cbed097a5dff454a"))
+	copy(keyB[:], mustHex(t, "f8307a2bc1870b00b828bb74dbb8fd88e632a6375ab3bcd1ae706aaa8b6cdd1d"))
+	copy(keyy[:], mustHex(t, "4865a5b7689dafd978f529291c7171bc159be076b92186405d13220b80e2a053"))
+	verification := mustHex(t, "78797a7a79")
+	clientHandshake := mustHex(t, "9fad2af287ef942632833d21f946c6260c33fae6172b60006e86e4a6911753a2f8307a2bc1870b00b828bb74dbb8fd88e632a6375ab3bcd1ae706aaa8b6cdd1d252fe9ae91264c91d4ecb8501f79d0387e34ad8ca0f7c995184f7d11d5da4f463bebd9151fd3b47c180abc9e044d53565f04d82bbb3bebed3d06cea65db8be9c72b68cd461942088502f67")
+	serverHandshake := mustHex(t, "4bf4814326fdab45ad5184f5518bd7fae25dc59374062698201a50a22954246d2fc5f8773ca824542bc6cf6f57c7c29bbf4e5476461ab130c5b18ab0a91276651202c3e1e87c0d32054c")
+	keys := mustHex(t, "9c19b631fd94ed86a817e01f6c80b0743a43f5faebd39cfaa8b00fa8bcc65c3bfeaa403d91acbd68a821bf6ee8504602b094a254392a07737d5662768c7a9fb1b2814bb34780eaee6e867c773e28c212ead563e98a1cd5d5b4576f5ee61c59bde025ff2851bb19b721421694f263818e3531e43a9e4e3e2c661e2ad547d8984caa28ebecd3e4525452299be26b9185a20a90ce1eac20a91f2832d731b54502b09749b5a2a2949292f8cfcbeffb790c7790ed935a9d251e7e336148ea83b063a5618fcff674a44581585fd22077ca0e52c59a24347a38d1a1ceebddbf238541f226b8f88d0fb9c07a1bcd2ea764bbbb5dacdaf5312a14c0b9e4f06309b0333b4a")
+
+	st, err := ntor3ServerReceive(clientHandshake, &keyb, &keyB, verification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(st.Message) != "hello world" {
+		t.Fatalf("client message: %q", st.Message)
+	}
+
+	reply, gotKeys, err := st.Reply(&keyy, []byte("Hola Mundo"), len(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, serverHandshake) {
+		t.Fatalf("server handshake:\n%x\n%x", reply, serverHandshake)
+	}
+	if !bytes.Equal(gotKeys, keys) {
+		t.Fatalf("keys:\n%x\n%x", gotKeys, keys)
+	}
+
+	// Tampering with the message must be noticed
+	clientHandshake[100] ^= 1
+	if _, err := ntor3ServerReceive(clientHandshake, &keyb, &keyB, verification); err == nil {
+		t.Fatal("accepted a bad MAC")
+	}
+
+	// A low-order X must not give us keys
+	var lowOrder ntor3Server
+	if _, _, err := lowOrder.Reply(&keyy, nil, len(keys)); err == nil {
+		t.Fatal("accepted a low-order client key")
+	}
+}
+
+func TestNtor3Extensions(t *testing.T) {
+	exts := []ntor3Extension{{NTOR3_EXT_CC_REQUEST, nil}, {7, []byte{1, 2, 3}}}
+	parsed, err := parseNtor3Extensions(encodeNtor3Extensions(exts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || parsed[0].kind != NTOR3_EXT_CC_REQUEST || !bytes.Equal(parsed[1].data, []byte{1, 2, 3}) {
+		t.Fatalf("bad round trip: %v", parsed)
+	}
+
+	if _, err := parseNtor3Extensions([]byte{1, 5, 10, 0}); err == nil {
+		t.Fatal("accepted a truncated extension")
+	}
+}
@@ -6,24 +6,41 @@ package main
 
 import (
 	"crypto/sha256"
+	"errors"
 	"io"
 	"net"
+	"time"
 )
 
 const READ_QUEUE_LENGTH = 100
 const WRITE_QUEUE_LENGTH = 2000
 const CIRC_QUEUE_LENGTH = 2000
 
+// How long the writer waits before asking the socket again when it had no room for circuit cells
+const KIST_RUN_INTERVAL = 10 * time.Millisecond
+const UNLIMITED_WRITE_BUDGET = 1 << 30
+
 type CircReadQueue chan CircuitCommand
 
 type OnionConnection struct {
 	parentOR         *ORCtx
 	readQueue        chan Cell
 	circuitReadQueue CircReadQueue
-	writeQueue       chan []byte
+	writeQueue       chan []byte // Cells that aren't part of a circuit's queue, these go first
+	scheduler        *CircuitScheduler
 	circuits         map[CircuitID]*Circuit
 	relayCircuits    map[CircuitID]*RelayCircuit
 
+	// IDs we recently destroyed, and when they can be used again
+	destroyedCircIDs map[CircuitID]time.Time
+	nextCircIDPrune  time.Time
+
+	// CREATEs that are waiting for an onionskin worker. Their results come back on onionskinResults, which has
+	// room for all of them: onionskinsInFlight also counts the ones whose circuit was destroyed in the meantime
+	pendingCreates     map[CircuitID]*onionskinJob
+	onionskinResults   chan *OnionskinResult
+	onionskinsInFlight int
+
 	usedTLSCtx        *TorTLS
 	negotiatedVersion LinkVersion
 
@@ -32,6 +49,12 @@ type OnionConnection struct {
 	theyAuthenticated   bool
 	theirFingerprint    Fingerprint
 	theirFingerprint256 []byte
+
+	// Set for inbound client connections that are counted by the DoS subsystem
+	dosAddr string
+
+	// Streams on our circuits whose goroutines are still running, see streamlimit.go
+	openStreams int32
 }
 
 func newOnionConnection(tlsctx *TorTLS, or *ORCtx) *OnionConnection {
@@ -41,8 +64,12 @@ func newOnionConnection(tlsctx *TorTLS, or *ORCtx) *OnionConnection {
 		usedTLSCtx:       tlsctx,
 		circuits:         make(map[CircuitID]*Circuit),
 		relayCircuits:    make(map[CircuitID]*RelayCircuit),
+		destroyedCircIDs: make(map[CircuitID]time.Time),
+		pendingCreates:   make(map[CircuitID]*onionskinJob),
+		onionskinResults: make(chan *OnionskinResult, MAX_PENDING_CREATES),
 		readQueue:        make(chan Cell, READ_QUEUE_LENGTH),
 		writeQueue:       make(chan []byte, WRITE_QUEUE_LENGTH),
+		scheduler:        NewCircuitScheduler(or.config.CircuitPriorityHalflife),
 		circuitReadQueue: make(CircReadQueue, CIRC_QUEUE_LENGTH),
 		parentOR:         or,
 	}
@@ -51,6 +78,10 @@ func newOnionConnection(tlsctx *TorTLS, or *ORCtx) *OnionConnection {
 func (c *OnionConnection) cleanup() {
 	StatsRemoveConnection()
 
+	if c.dosAddr != "" {
+		c.parentOR.DoSConnectionClosed(c.dosAddr)
+	}
+
 	if c.theyAuthenticated {
 		if err := c.parentOR.EndConnection(c.theirFingerprint, c); err != nil {
 			Log(LOG_NOTICE, "Warning during deregistration: %s", err)
@@ -78,11 +109,14 @@ readTheQueue:
 			creationRequest, ok := cmd.(*CircuitRequest)
 			if ok {
 				creationRequest.successQueue <- &CircuitDestroyed{
-					reason: 8, // OR_CONN_CLOSED
+					reason: DESTROY_REASON_OR_CONN_CLOSED,
 					id:     creationRequest.localID,
 					//truncate: true,
 				}
 			}
+			if u, ok := cmd.(UndeliverableCommand); ok {
+				u.Undeliverable()
+			}
 
 			cmd.ReleaseBuffers()
 		default:
@@ -91,6 +125,19 @@ readTheQueue:
 	}
 }
 
+func (c *OnionConnection) queueWrite(data []byte) {
+	c.writeQueue <- data
+}
+
+func (c *OnionConnection) queueCircuitWrite(q *CircuitQueue, data []byte) ActionableError {
+	q.account.Add()
+	if !c.scheduler.Push(q, data) {
+		q.account.Remove()
+		return CloseCircuit(errors.New("circuit queue is full"), DESTROY_REASON_RESOURCELIMIT)
+	}
+	return nil
+}
+
 func HandleORConnClient(or *ORCtx, conn net.Conn, req *CircuitRequest) {
 	// XXX WTF BUG: The Tor spec requires us to allow AUTHORIZE/VPADDING before VERSIONS
 
@@ -122,7 +169,7 @@ func HandleORConnClient(or *ORCtx, conn net.Conn, req *CircuitRequest) {
 	hash_outbound := sha256.New()
 
 	// Spawn the reader later - we still need to negotiate the version
-	go me.writer(tlsConn)
+	go me.writer(tlsConn, newSocketMonitor(conn))
 
 	if err := me.negotiateVersionClient(tlsConn, hash_inbound, hash_outbound); err != nil {
 		Log(LOG_INFO, "%s", err)
@@ -188,8 +235,16 @@ handshake:
 }
 
 func HandleORConnServer(or *ORCtx, conn net.Conn) {
+	// Counted from the start, so that connections that never finish their handshake count as well
+	dosAddr := dosClientAddress(conn.RemoteAddr())
+	if !or.DoSConnectionOpened(dosAddr) {
+		Log(LOG_INFO, "Too many concurrent connections from %s. Disconnecting", dosAddr)
+		return
+	}
+
 	tlsConn, usedTLSCtx, err := or.WrapTLS(conn, false)
 	if err != nil {
+		or.DoSConnectionClosed(dosAddr)
 		Log(LOG_WARN, "%s", err)
 		return
 	}
@@ -197,10 +252,11 @@ func HandleORConnServer(or *ORCtx, conn net.Conn) {
 
 	me := newOnionConnection(usedTLSCtx, or)
 	me.isOutbound = false
+	me.dosAddr = dosAddr
 	defer me.cleanup()
 
 	// Spawn the reader later - we still need to negotiate the version
-	go me.writer(tlsConn)
+	go me.writer(tlsConn, newSocketMonitor(conn))
 
 	if err := me.negotiateVersionServer(tlsConn); err != nil {
 		Log(LOG_INFO, "%s", err)
@@ -257,12 +313,21 @@ handshake:
 		cell.ReleaseBuffers()
 	}
 
+	if me.theyAuthenticated {
+		// Relays aren't subject to the DoS limits
+		or.DoSConnectionClosed(me.dosAddr)
+		me.dosAddr = ""
+	}
+
 	me.Runloop()
 }
 
 func (me *OnionConnection) Runloop() {
 	Log(LOG_CIRC, "handshake done, runloop starting")
 
+	sweepTicker := time.NewTicker(CIRC_SWEEP_INTERVAL)
+	defer sweepTicker.Stop()
+
 	for {
 		var err ActionableError
 		var circID CircuitID // XXX This is messed up.
@@ -287,6 +352,12 @@ func (me *OnionConnection) Runloop() {
 
 			err = me.routeCircuitCommandToFunction(circData)
 			circData.ReleaseBuffers()
+
+		case result := <-me.onionskinResults:
+			err = result.Handle(me)
+
+		case now := <-sweepTicker.C:
+			me.sweepCircuits(now)
 		}
 
 		if err != nil {
@@ -301,7 +372,7 @@ func (me *OnionConnection) Runloop() {
 					return
 				}
 
-				me.writeQueue <- NewCell(me.negotiatedVersion, circID, CMD_DESTROY, []byte{byte(err.CircDestroyReason())}).Bytes()
+				me.queueWrite(NewCell(me.negotiatedVersion, circID, CMD_DESTROY, []byte{byte(err.CircDestroyReason())}).Bytes())
 
 				if circID.MSB(me.negotiatedVersion) != me.isOutbound { // Front
 					circ, ok := me.circuits[circID]
@@ -330,7 +401,7 @@ func (me *OnionConnection) Runloop() {
 					return
 				}
 
-				me.writeQueue <- NewCell(me.negotiatedVersion, circID, CMD_DESTROY, []byte{byte(err.CircDestroyReason())}).Bytes()
+				me.queueWrite(NewCell(me.negotiatedVersion, circID, CMD_DESTROY, []byte{byte(err.CircDestroyReason())}).Bytes())
 
 			default:
 				Log(LOG_WARN, "Disconnecting: not sure what to do with error %v", err)
@@ -415,7 +486,7 @@ func (c *OnionConnection) reader(conn io.Reader) {
 	}
 }
 
-func (c *OnionConnection) writer(conn net.Conn) {
+func (c *OnionConnection) writer(conn net.Conn, socket *socketMonitor) {
 	defer func() {
 		Log(LOG_INFO, "writer ended")
 		conn.Close()
@@ -423,60 +494,89 @@ func (c *OnionConnection) writer(conn net.Conn) {
 
 	var buffer [SSLRecordSize]byte
 	var nextItem []byte
+	closed := false
 
-	for {
+	for !closed {
+		datalen := 0
 		if nextItem != nil {
-			_, err := conn.Write(nextItem)
-			if err != nil {
-				Log(LOG_INFO, "%s", err)
-				return
-			}
+			datalen = copy(buffer[:], nextItem)
 			ReturnCellBuf(nextItem)
 			nextItem = nil
 		}
 
-		select {
-		case data, ok := <-c.writeQueue:
-			if !ok {
-				return
-			}
-
-			Log(LOG_DEBUG, "writing %d: %v", len(data), data)
+		budget := socket.WriteBudget()
 
-			datalen := len(data)
-			copy(buffer[:], data)
-			ReturnCellBuf(data)
+		if datalen == 0 {
+			var wakeup <-chan time.Time
+			var ready <-chan struct{}
+			if !c.scheduler.Pending() {
+				ready = c.scheduler.ready
+			} else if budget < MAX_CELL_SIZE {
+				wakeup = time.After(KIST_RUN_INTERVAL)
+			}
 
-		extradata:
-			for { // See if we got any extra data
+			if ready != nil || wakeup != nil {
 				select {
-				case data2, ok := <-c.writeQueue:
+				case data, ok := <-c.writeQueue:
 					if !ok {
-						break extradata
+						return
 					}
+					datalen = copy(buffer[:], data)
+					ReturnCellBuf(data)
 
-					if datalen+len(data2) > cap(buffer) {
-						nextItem = data2
-						break extradata
-					}
+				case <-ready:
+				case <-wakeup:
+					budget = socket.WriteBudget()
+				}
+			}
+		}
 
-					copy(buffer[datalen:], data2)
-					datalen += len(data2)
-					ReturnCellBuf(data2)
+	fill:
+		for datalen+MAX_CELL_SIZE <= cap(buffer) {
+			// Cells outside of circuits first, then whichever circuit the scheduler picks
+			select {
+			case data, ok := <-c.writeQueue:
+				if !ok {
+					closed = true
+					break fill
+				}
 
-					if datalen+MAX_CELL_SIZE > cap(buffer) {
-						break extradata
-					}
-				default:
-					break extradata
+				if datalen+len(data) > cap(buffer) {
+					nextItem = data
+					break fill
 				}
-			}
 
-			_, err := conn.Write(buffer[:datalen])
-			if err != nil {
-				Log(LOG_INFO, "%s", err)
-				return
+				copy(buffer[datalen:], data)
+				datalen += len(data)
+				ReturnCellBuf(data)
+
+			default:
+				if budget < MAX_CELL_SIZE {
+					break fill
+				}
+
+				data := c.scheduler.Next()
+				if data == nil {
+					break fill
+				}
+
+				copy(buffer[datalen:], data)
+				datalen += len(data)
+				budget -= len(data)
+				ReturnCellBuf(data)
 			}
 		}
+
+		if datalen == 0 {
+			continue
+		}
+
+		Log(LOG_DEBUG, "writing %d: %v", datalen, buffer[:datalen])
+
+		_, err := conn.Write(buffer[:datalen])
+		if err != nil {
+			Log(LOG_INFO, "%s", err)
+			return
+		}
 	}
 }
@@ -0,0 +1,218 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/tvdw/openssl"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Onion keys get replaced every ONION_KEY_LIFETIME. Clients may still use the previous keys from an older
+// descriptor, so we keep accepting those for ONION_KEY_GRACE_PERIOD after a rotation.
+const (
+	ONION_KEY_LIFETIME     = 28 * 24 * time.Hour
+	ONION_KEY_GRACE_PERIOD = 7 * 24 * time.Hour
+)
+
+type ntorKeyPair struct {
+	private, public [32]byte
+}
+
+func generateNtorKey() *ntorKeyPair {
+	k := &ntorKeyPair{}
+	CRandBytes(k.private[:])
+	k.private[0] &= 248
+	k.private[31] &= 127
+	k.private[31] |= 64
+	curve25519.ScalarBaseMult(&k.public, &k.private)
+	return k
+}
+
+func (k *ntorKeyPair) save(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString("== c25519v1: onion ==")
+	for i := buf.Len(); i < 32; i++ {
+		buf.Write([]byte{0})
+	}
+	buf.Write(k.private[:])
+	buf.Write(k.public[:])
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+func loadNtorKey(path string) (*ntorKeyPair, error) {
+	ntorData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(ntorData) != 96 {
+		return nil, errors.New("ntor data corrupt")
+	}
+
+	k := &ntorKeyPair{}
+	copy(k.private[:], ntorData[32:64])
+	copy(k.public[:], ntorData[64:96])
+	return k, nil
+}
+
+func generateOnionKey(path string) error {
+	newOnionKey, err := openssl.GenerateRSAKeyWithExponent(1024, 65537)
+	if err != nil {
+		return err
+	}
+	newOnionKeyPEM, err := newOnionKey.MarshalPKCS1PrivateKeyPEM()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, newOnionKeyPEM, 0600)
+}
+
+func loadOnionKey(path string) (openssl.PrivateKey, error) {
+	onionPem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openssl.LoadPrivateKeyFromPEM(onionPem)
+}
+
+func (or *ORCtx) onionKeyPath(name string) string {
+	return or.config.DataDirectory + "/keys/" + name
+}
+
+// Creates whichever of our onion keys don't exist yet. Without TAP we have no use for the RSA one
+func (or *ORCtx) generateOnionKeys() error {
+	if !or.config.RefuseTAP {
+		if _, err := os.Stat(or.onionKeyPath("secret_onion_key")); os.IsNotExist(err) {
+			if err := generateOnionKey(or.onionKeyPath("secret_onion_key")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := os.Stat(or.onionKeyPath("secret_onion_key_ntor")); os.IsNotExist(err) {
+		return generateNtorKey().save(or.onionKeyPath("secret_onion_key_ntor"))
+	}
+	return nil
+}
+
+// Reads the current onion keys, and the previous ones if they are still within their grace period
+func (or *ORCtx) loadOnionKeys() error {
+	var onionKey openssl.PrivateKey
+	if !or.config.RefuseTAP {
+		var err error
+		onionKey, err = loadOnionKey(or.onionKeyPath("secret_onion_key"))
+		if err != nil {
+			return err
+		}
+	}
+
+	ntorKey, err := loadNtorKey(or.onionKeyPath("secret_onion_key_ntor"))
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(or.onionKeyPath("secret_onion_key_ntor"))
+	if err != nil {
+		return err
+	}
+	created := stat.ModTime()
+
+	var oldOnionKey openssl.PrivateKey
+	var oldNtorKey *ntorKeyPair
+	if time.Since(created) < ONION_KEY_GRACE_PERIOD {
+		// Not having them is fine, we may never have rotated before
+		if !or.config.RefuseTAP {
+			oldOnionKey, _ = loadOnionKey(or.onionKeyPath("secret_onion_key.old"))
+		}
+		oldNtorKey, _ = loadNtorKey(or.onionKeyPath("secret_onion_key_ntor.old"))
+	}
+
+	or.onionKeyLock.Lock()
+	or.onionKey, or.oldOnionKey = onionKey, oldOnionKey
+	or.ntorKey, or.oldNtorKey = ntorKey, oldNtorKey
+	or.onionKeyCreated = created
+	or.onionKeyLock.Unlock()
+
+	return nil
+}
+
+// Replaces the onion keys once they are old enough, keeping the current ones as .old. Returns whether the
+// keys changed, in which case the descriptor should be republished.
+func (or *ORCtx) MaybeRotateOnionKeys() (bool, error) {
+	or.onionKeyLock.RLock()
+	created := or.onionKeyCreated
+	hasOld := or.oldOnionKey != nil || or.oldNtorKey != nil
+	or.onionKeyLock.RUnlock()
+
+	if time.Since(created) < ONION_KEY_LIFETIME {
+		if hasOld && time.Since(created) >= ONION_KEY_GRACE_PERIOD {
+			or.onionKeyLock.Lock()
+			or.oldOnionKey, or.oldNtorKey = nil, nil
+			or.onionKeyLock.Unlock()
+		}
+		return false, nil
+	}
+
+	Log(LOG_NOTICE, "Rotating onion keys")
+
+	// Write the new keys next to the current ones first, so that failing to generate them leaves the current
+	// ones in place
+	names := []string{"secret_onion_key_ntor"}
+	if err := generateNtorKey().save(or.onionKeyPath("secret_onion_key_ntor.new")); err != nil {
+		return false, err
+	}
+	if !or.config.RefuseTAP {
+		names = append(names, "secret_onion_key")
+		if err := generateOnionKey(or.onionKeyPath("secret_onion_key.new")); err != nil {
+			return false, err
+		}
+	}
+
+	for _, name := range names {
+		err := os.Rename(or.onionKeyPath(name), or.onionKeyPath(name+".old"))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if err := os.Rename(or.onionKeyPath(name+".new"), or.onionKeyPath(name)); err != nil {
+			return false, err
+		}
+	}
+	if err := or.loadOnionKeys(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Finds the ntor key a client used, by its public part. Returns nil if it's not one of ours
+func (or *ORCtx) ntorKeyByID(keyID []byte) *ntorKeyPair {
+	or.onionKeyLock.RLock()
+	defer or.onionKeyLock.RUnlock()
+
+	for _, k := range []*ntorKeyPair{or.ntorKey, or.oldNtorKey} {
+		if k != nil && bytes.Equal(k.public[:], keyID) {
+			return k
+		}
+	}
+	return nil
+}
+
+// TAP onionskins don't say which key they are for, so we try each of these in turn
+func (or *ORCtx) tapKeys() []openssl.PrivateKey {
+	or.onionKeyLock.RLock()
+	defer or.onionKeyLock.RUnlock()
+
+	var keys []openssl.PrivateKey
+	for _, k := range []openssl.PrivateKey{or.onionKey, or.oldOnionKey} {
+		if k != nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
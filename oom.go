@@ -0,0 +1,188 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every cell we queue on behalf of a circuit is accounted for in the circuit's QueueAccount. When the total goes
+// over MaxMemInQueues we kill the circuits whose oldest queued cell has been waiting the longest, like Tor does.
+
+type QueueAccount struct {
+	or       *ORCtx
+	queue    CircReadQueue
+	id       CircuitID
+	forRelay bool
+
+	lock     sync.Mutex
+	queued   []time.Time // When each queued cell was added, oldest first
+	released bool
+}
+
+func (or *ORCtx) NewQueueAccount(queue CircReadQueue, id CircuitID, forRelay bool) *QueueAccount {
+	a := &QueueAccount{
+		or:       or,
+		queue:    queue,
+		id:       id,
+		forRelay: forRelay,
+	}
+
+	or.queueAccountsLock.Lock()
+	or.queueAccounts[a] = struct{}{}
+	or.queueAccountsLock.Unlock()
+
+	return a
+}
+
+func (a *QueueAccount) Add() {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	if a.released {
+		a.lock.Unlock()
+		return
+	}
+	a.queued = append(a.queued, time.Now())
+	a.lock.Unlock()
+
+	total := atomic.AddInt64(&a.or.queuedBytes, MAX_CELL_SIZE)
+	if limit := a.or.config.MaxMemInQueues; limit != 0 && total > limit {
+		a.or.handleOOM()
+	}
+}
+
+func (a *QueueAccount) Remove() {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	if a.released || len(a.queued) == 0 {
+		a.lock.Unlock()
+		return
+	}
+	a.queued[0] = time.Time{}
+	a.queued = a.queued[1:]
+	a.lock.Unlock()
+
+	atomic.AddInt64(&a.or.queuedBytes, -MAX_CELL_SIZE)
+}
+
+// Stops accounting for this circuit. Returns the amount of bytes that were still queued
+func (a *QueueAccount) Release() int64 {
+	if a == nil {
+		return 0
+	}
+
+	a.lock.Lock()
+	if a.released {
+		a.lock.Unlock()
+		return 0
+	}
+	a.released = true
+	freed := int64(len(a.queued)) * MAX_CELL_SIZE
+	a.queued = nil
+	a.lock.Unlock()
+
+	atomic.AddInt64(&a.or.queuedBytes, -freed)
+
+	a.or.queueAccountsLock.Lock()
+	delete(a.or.queueAccounts, a)
+	a.or.queueAccountsLock.Unlock()
+
+	return freed
+}
+
+func (a *QueueAccount) oldest() (time.Time, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.queued) == 0 {
+		return time.Time{}, false
+	}
+	return a.queued[0], true
+}
+
+type circuitOOMKill struct {
+	NoBuffers
+	id       CircuitID
+	forRelay bool
+}
+
+func (k *circuitOOMKill) CircID() CircuitID {
+	return k.id
+}
+
+func (k *circuitOOMKill) ForRelay() bool {
+	return k.forRelay
+}
+
+func (k *circuitOOMKill) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	return CloseCircuit(errors.New("killed by the OOM handler"), DESTROY_REASON_RESOURCELIMIT)
+}
+
+func (k *circuitOOMKill) HandleRelay(c *OnionConnection, circ *RelayCircuit) ActionableError {
+	return CloseCircuit(errors.New("killed by the OOM handler"), DESTROY_REASON_RESOURCELIMIT)
+}
+
+func (or *ORCtx) handleOOM() {
+	if !atomic.CompareAndSwapInt32(&or.oomRunning, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&or.oomRunning, 0)
+
+	limit := or.config.MaxMemInQueues
+	total := atomic.LoadInt64(&or.queuedBytes)
+	if total <= limit {
+		return
+	}
+	// Free enough to get back to 90% of the limit, so we don't get here again right away
+	target := total - (limit/10)*9
+
+	type candidate struct {
+		account *QueueAccount
+		oldest  time.Time
+	}
+	var candidates []candidate
+
+	or.queueAccountsLock.Lock()
+	for a := range or.queueAccounts {
+		if oldest, ok := a.oldest(); ok {
+			candidates = append(candidates, candidate{a, oldest})
+		}
+	}
+	or.queueAccountsLock.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].oldest.Before(candidates[j].oldest)
+	})
+
+	var freed int64
+	killed := 0
+	for _, cand := range candidates {
+		if freed >= target {
+			break
+		}
+
+		// Only let go of the cells once the circuit is sure to die. If we can't tell it, the next pass tries again
+		a := cand.account
+		select {
+		case a.queue <- &circuitOOMKill{id: a.id, forRelay: a.forRelay}:
+			freed += a.Release()
+			killed++
+		default:
+			Log(LOG_INFO, "OOM handler could not notify the connection of circuit %d", a.id)
+		}
+	}
+
+	Log(LOG_NOTICE, "Queued cells were using %d bytes, over our limit of %d. Killed %d circuits, freeing %d bytes",
+		total, limit, killed, freed)
+}
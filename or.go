@@ -5,15 +5,15 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha1"
 	"errors"
 	"fmt"
 	"github.com/tvdw/gotor/tordir"
 	"github.com/tvdw/openssl"
-	"golang.org/x/crypto/curve25519"
 	"io/ioutil"
 	"net"
 	"os"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -35,12 +35,36 @@ type ORCtx struct {
 	authConnLock             sync.Mutex
 
 	descriptor tordir.Descriptor
+	directory  dirDocuments
 
-	identityKey, onionKey   openssl.PrivateKey
-	ntorPrivate, ntorPublic [32]byte
+	identityKey openssl.PrivateKey
+
+	// Current and previous onion keys, see onionkey.go
+	onionKey, oldOnionKey openssl.PrivateKey
+	ntorKey, oldNtorKey   *ntorKeyPair
+	onionKeyCreated       time.Time
+	onionKeyLock          sync.RWMutex
+
+	confluxSets map[[CONFLUX_NONCE_LEN]byte]*ConfluxSet
+	confluxLock sync.Mutex
 
 	clientTlsCtx, serverTlsCtx *TorTLS
 	tlsLock                    sync.Mutex
+
+	// Per client address DoS mitigation state
+	dosClients map[string]*dosClientStats
+	dosLock    sync.Mutex
+
+	onionskins *OnionskinPool
+
+	// Exit streams with a socket, see streamlimit.go
+	openExitStreams int32
+
+	// Cells queued on behalf of circuits, see oom.go
+	queuedBytes       int64
+	oomRunning        int32
+	queueAccounts     map[*QueueAccount]struct{}
+	queueAccountsLock sync.Mutex
 }
 
 func NewOR(torConf *Config) (*ORCtx, error) {
@@ -53,8 +77,12 @@ func NewOR(torConf *Config) (*ORCtx, error) {
 	ctx := &ORCtx{
 		listener:                 listener,
 		authenticatedConnections: make(map[Fingerprint]*OnionConnection),
-		config: torConf,
+		dosClients:               make(map[string]*dosClientStats),
+		queueAccounts:            make(map[*QueueAccount]struct{}),
+		confluxSets:              make(map[[CONFLUX_NONCE_LEN]byte]*ConfluxSet),
+		config:                   torConf,
 	}
+	ctx.directory.fallback = dirPortFallback(torConf)
 
 	if _, err := os.Stat(torConf.DataDirectory + "/keys/secret_id_key"); os.IsNotExist(err) {
 		Log(LOG_INFO, "Generating new keys")
@@ -74,41 +102,10 @@ func NewOR(torConf *Config) (*ORCtx, error) {
 				return nil, err
 			}
 		}
+	}
 
-		{
-			newOnionKey, err := openssl.GenerateRSAKeyWithExponent(1024, 65537)
-			if err != nil {
-				return nil, err
-			}
-			newOnionKeyPEM, err := newOnionKey.MarshalPKCS1PrivateKeyPEM()
-			if err != nil {
-				return nil, err
-			}
-			if err := ioutil.WriteFile(torConf.DataDirectory+"/keys/secret_onion_key", newOnionKeyPEM, 0600); err != nil {
-				return nil, err
-			}
-		}
-
-		{
-			var curveDataPriv [32]byte
-			var curveDataPub [32]byte
-			CRandBytes(curveDataPriv[0:32])
-			curveDataPriv[0] &= 248
-			curveDataPriv[31] &= 127
-			curveDataPriv[31] |= 64
-			curve25519.ScalarBaseMult(&curveDataPub, &curveDataPriv)
-
-			var buf bytes.Buffer
-			buf.WriteString("== c25519v1: onion ==")
-			for i := buf.Len(); i < 32; i++ {
-				buf.Write([]byte{0})
-			}
-			buf.Write(curveDataPriv[:])
-			buf.Write(curveDataPub[:])
-			if err := ioutil.WriteFile(torConf.DataDirectory+"/keys/secret_onion_key_ntor", buf.Bytes(), 0600); err != nil {
-				return nil, err
-			}
-		}
+	if err := ctx.generateOnionKeys(); err != nil {
+		return nil, err
 	}
 
 	{
@@ -122,33 +119,20 @@ func NewOR(torConf *Config) (*ORCtx, error) {
 		}
 		ctx.identityKey = identityPk
 	}
-	{
-		onionPem, err := ioutil.ReadFile(torConf.DataDirectory + "/keys/secret_onion_key")
-		if err != nil {
-			return nil, err
-		}
-		onionPk, err := openssl.LoadPrivateKeyFromPEM(onionPem)
-		if err != nil {
-			return nil, err
-		}
-		ctx.onionKey = onionPk
-	}
-	{
-		ntorData, err := ioutil.ReadFile(torConf.DataDirectory + "/keys/secret_onion_key_ntor")
-		if err != nil {
-			return nil, err
-		}
-		if len(ntorData) != 96 {
-			return nil, errors.New("ntor data corrupt")
-		}
-		copy(ctx.ntorPrivate[:], ntorData[32:64])
-		copy(ctx.ntorPublic[:], ntorData[64:96])
+	if err := ctx.loadOnionKeys(); err != nil {
+		return nil, err
 	}
 
 	if err := SetupTLS(ctx); err != nil {
 		return nil, err
 	}
 
+	workers := torConf.NumCPUs
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	ctx.onionskins = NewOnionskinPool(ctx, workers, torConf.MaxOnionQueueDelay)
+
 	ctx.descriptor.UptimeStart = time.Now()
 
 	return ctx, nil
@@ -163,14 +147,17 @@ func (or *ORCtx) UpdateDescriptor() {
 	d.Nickname = or.config.Nickname
 	d.Contact = or.config.Contact
 	d.Platform = or.config.Platform
+	d.Protocols = OUR_PROTOCOLS
 	d.Address = net.ParseIP(or.config.Address)
 	d.ORPort = or.config.ORPort
+	or.onionKeyLock.RLock()
 	d.OnionKey = or.onionKey
+	d.NTORKey = or.ntorKey.public[:]
+	or.onionKeyLock.RUnlock()
 	d.SigningKey = or.identityKey
 	d.BandwidthAvg = or.config.BandwidthAvg
 	d.BandwidthBurst = or.config.BandwidthBurst
 	d.BandwidthObserved = or.config.BandwidthObserved
-	d.NTORKey = or.ntorPublic[:]
 	d.Family = or.config.Family
 	policy, err := or.config.ExitPolicy.Describe()
 	if err != nil {
@@ -178,14 +165,25 @@ func (or *ORCtx) UpdateDescriptor() {
 		return
 	}
 	d.ExitPolicy = policy
+	d.ExitStats = ""
+	if or.config.ExitPortStatistics {
+		d.ExitStats = exitStats.Describe(time.Now())
+	}
+	d.IPv6Policy = ""
+	if or.config.IPv6Exit {
+		d.IPv6Policy = or.config.ExitPolicy.DescribeIPv6()
+	}
 
-	signed, err := d.SignedDescriptor()
+	signed, extra, err := d.SignedDocuments()
 	if err != nil {
 		Log(LOG_WARN, "%s", err)
 		return
 	}
 
-	Log(LOG_DEBUG, "%s", signed)
+	keyDer, _ := or.identityKey.MarshalPKCS1PublicKeyDER()
+	or.directory.Set(fmt.Sprintf("%X", sha1.Sum(keyDer)), signed, extra)
+
+	Log(LOG_DEBUG, "%s%s", signed, extra)
 }
 
 func (or *ORCtx) PublishDescriptor() error {
@@ -281,6 +279,9 @@ func (or *ORCtx) RequestCircuit(req *CircuitRequest) error {
 			// Now connect
 			Log(LOG_INFO, "connecting to %s", addr)
 			dialer := net.Dialer{Timeout: 5 * time.Second}
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				dialer.LocalAddr = or.config.OutboundBindAddr(false, net.ParseIP(host))
+			}
 			conn, err := dialer.Dial("tcp", addr)
 			if err != nil {
 				Log(LOG_INFO, "%s", err)
@@ -11,6 +11,10 @@ type RelayCommand byte
 type DestroyReason byte
 type StreamEndReason byte
 
+// The subprotocol versions we implement, for the proto line of our descriptor. Relay=4 is ntor v3, FlowCtrl=2 is
+// congestion control.
+const OUR_PROTOCOLS = "Conflux=1 FlowCtrl=1-2 Link=4 LinkAuth=1 Relay=1-4"
+
 const (
 	CMD_PADDING        Command = 0
 	CMD_CREATE         Command = 1
@@ -32,21 +36,34 @@ const (
 )
 
 const (
-	RELAY_BEGIN     RelayCommand = 1
-	RELAY_DATA      RelayCommand = 2
-	RELAY_END       RelayCommand = 3
-	RELAY_CONNECTED RelayCommand = 4
-	RELAY_SENDME    RelayCommand = 5
-	RELAY_EXTEND    RelayCommand = 6
-	RELAY_EXTENDED  RelayCommand = 7
-	RELAY_TRUNCATE  RelayCommand = 8
-	RELAY_TRUNCATED RelayCommand = 9
-	RELAY_DROP      RelayCommand = 10
-	RELAY_RESOLVE   RelayCommand = 11
-	RELAY_RESOLVED  RelayCommand = 12
-	RELAY_BEGIN_DIR RelayCommand = 13
-	RELAY_EXTEND2   RelayCommand = 14
-	RELAY_EXTENDED2 RelayCommand = 15
+	RELAY_BEGIN              RelayCommand = 1
+	RELAY_DATA               RelayCommand = 2
+	RELAY_END                RelayCommand = 3
+	RELAY_CONNECTED          RelayCommand = 4
+	RELAY_SENDME             RelayCommand = 5
+	RELAY_EXTEND             RelayCommand = 6
+	RELAY_EXTENDED           RelayCommand = 7
+	RELAY_TRUNCATE           RelayCommand = 8
+	RELAY_TRUNCATED          RelayCommand = 9
+	RELAY_DROP               RelayCommand = 10
+	RELAY_RESOLVE            RelayCommand = 11
+	RELAY_RESOLVED           RelayCommand = 12
+	RELAY_BEGIN_DIR          RelayCommand = 13
+	RELAY_EXTEND2            RelayCommand = 14
+	RELAY_EXTENDED2          RelayCommand = 15
+	RELAY_CONFLUX_LINK       RelayCommand = 35
+	RELAY_CONFLUX_LINKED     RelayCommand = 36
+	RELAY_CONFLUX_LINKED_ACK RelayCommand = 37
+	RELAY_CONFLUX_SWITCH     RelayCommand = 38
+	RELAY_XOFF               RelayCommand = 43
+	RELAY_XON                RelayCommand = 44
+)
+
+// Flags in RELAY_BEGIN
+const (
+	BEGIN_FLAG_IPV6_OK        = 1 << 0
+	BEGIN_FLAG_IPV4_NOT_OK    = 1 << 1
+	BEGIN_FLAG_IPV6_PREFERRED = 1 << 2
 )
 
 const (
@@ -156,6 +173,18 @@ func (c RelayCommand) String() string {
 		return "RELAY_EXTEND2"
 	case RELAY_EXTENDED2:
 		return "RELAY_EXTENDED2"
+	case RELAY_CONFLUX_LINK:
+		return "RELAY_CONFLUX_LINK"
+	case RELAY_CONFLUX_LINKED:
+		return "RELAY_CONFLUX_LINKED"
+	case RELAY_CONFLUX_LINKED_ACK:
+		return "RELAY_CONFLUX_LINKED_ACK"
+	case RELAY_CONFLUX_SWITCH:
+		return "RELAY_CONFLUX_SWITCH"
+	case RELAY_XOFF:
+		return "RELAY_XOFF"
+	case RELAY_XON:
+		return "RELAY_XON"
 	default:
 		return fmt.Sprintf("RELAY_UNKNOWN_%d", c)
 	}
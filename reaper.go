@@ -0,0 +1,53 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+)
+
+const CIRC_SWEEP_INTERVAL = 30 * time.Second
+
+type CircuitSweepResult struct {
+	Idle, Extend, Lifetime, Conflux int
+}
+
+func (r CircuitSweepResult) Total() int {
+	return r.Idle + r.Extend + r.Lifetime + r.Conflux
+}
+
+// Destroys all circuits that exceeded one of the configured limits. Each circuit is counted under the first limit it hit.
+func (c *OnionConnection) sweepCircuits(now time.Time) CircuitSweepResult {
+	var result CircuitSweepResult
+	config := c.parentOR.config
+
+	for _, circ := range c.circuits {
+		switch {
+		case config.MaxCircuitLifetime != 0 && now.Sub(circ.created) > config.MaxCircuitLifetime:
+			result.Lifetime++
+		case config.CircuitExtendTimeout != 0 && circ.extendState != nil && now.Sub(circ.extendStarted) > config.CircuitExtendTimeout:
+			result.Extend++
+		case config.CircuitIdleTimeout != 0 && now.Sub(circ.lastActivity) > config.CircuitIdleTimeout:
+			result.Idle++
+		case circ.conflux != nil && circ.conflux.shouldClose(now):
+			result.Conflux++
+		default:
+			continue
+		}
+
+		c.queueWrite(NewCell(c.negotiatedVersion, circ.id, CMD_DESTROY, []byte{byte(DESTROY_REASON_TIMEOUT)}).Bytes())
+		c.destroyCircuit(circ, true, true, DESTROY_REASON_TIMEOUT)
+	}
+
+	if result.Total() != 0 {
+		StatsUpd(STATCTR_CIRC_TIMEOUT_IDLE, int32(result.Idle))
+		StatsUpd(STATCTR_CIRC_TIMEOUT_EXTEND, int32(result.Extend))
+		StatsUpd(STATCTR_CIRC_TIMEOUT_LIFETIME, int32(result.Lifetime))
+		Log(LOG_INFO, "Reaped %d circuits: %d idle, %d with an unfinished extend, %d past their lifetime, %d in a broken conflux set",
+			result.Total(), result.Idle, result.Extend, result.Lifetime, result.Conflux)
+	}
+
+	return result
+}
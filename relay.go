@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const MAX_RELAY_LEN = 514 - 11 - 5
@@ -25,51 +27,23 @@ func (c *OnionConnection) handleRelayBackward(circ *RelayCircuit, cell Cell) Act
 	copy(data, origData)
 	data = data[0:len(origData)]
 
+	circ.queue.Add()
 	circ.previousHop <- &RelayData{
 		id:       circ.theirID,
 		data:     data,
 		forRelay: false,
+		account:  circ.queue,
 	}
 
 	return nil
 }
 
 func (c *OnionConnection) handleRelayForward(circ *Circuit, cell Cell) ActionableError {
-	cstate := circ.forward
+	dec := GetCellBuf(false)
+	dec = dec[:len(cell.Data())]
+	copy(dec, cell.Data())
 
-	dec, err := cstate.cipher.Crypt(cell.Data(), GetCellBuf(false))
-	if err != nil {
-		return CloseCircuit(err, DESTROY_REASON_INTERNAL)
-	}
-
-	rcell := RelayCell{dec}
-
-	should_be_forwarded := false
-
-	if !rcell.Recognized() {
-		should_be_forwarded = true
-	}
-
-	if !should_be_forwarded {
-		tmpCell := GetCellBuf(false)
-		defer ReturnCellBuf(tmpCell)
-		copy(tmpCell, rcell.bytes)
-		tmpCell = tmpCell[:len(rcell.bytes)]
-		tmpCell[5] = 0
-		tmpCell[6] = 0
-		tmpCell[7] = 0
-		tmpCell[8] = 0
-
-		old_dig := cstate.digest.Clone() // XXX rofl
-
-		cstate.digest.Write(tmpCell)
-		their_digest := rcell.Digest()
-		our_digest := cstate.digest.Sum(nil)
-		if their_digest[0] != our_digest[0] || their_digest[1] != our_digest[1] || their_digest[2] != our_digest[2] || their_digest[3] != our_digest[3] {
-			cstate.digest = old_dig // XXX Find a better way to do this :-)
-			should_be_forwarded = true
-		}
-	}
+	should_be_forwarded := !circ.forward.Decrypt(dec)
 
 	if should_be_forwarded {
 		if circ.nextHop == nil {
@@ -77,61 +51,104 @@ func (c *OnionConnection) handleRelayForward(circ *Circuit, cell Cell) Actionabl
 			return CloseCircuit(errors.New("cannot forward that!"), DESTROY_REASON_PROTOCOL)
 		}
 
+		circ.queue.Add()
 		circ.nextHop <- &RelayData{
 			id:       circ.nextHopID,
 			data:     dec,
 			forRelay: true,
 			rType:    cell.Command(),
+			account:  circ.queue,
 		}
 		return nil
 	}
 
 	defer ReturnCellBuf(dec)
 
+	msgs, err := circ.relayMessages(dec)
+	if err != nil {
+		return CloseCircuit(err, DESTROY_REASON_PROTOCOL)
+	}
+
+	return c.handleRelayDecrypted(circ, cell, msgs)
+}
+
+// Parses a decrypted cell that is meant for us. Each cell carries a single message
+func (circ *Circuit) relayMessages(dec []byte) ([]*RelayMessage, error) {
+	rcell := RelayCell{dec}
 	if rcell.Length()+11 > len(dec) {
-		return CloseCircuit(errors.New("Malformed relay cell"), DESTROY_REASON_PROTOCOL)
+		return nil, errors.New("Malformed relay cell")
 	}
+	return []*RelayMessage{rcell.Message()}, nil
+}
 
-	return c.handleRelayDecrypted(circ, cell, &rcell)
+func (c *OnionConnection) handleRelayDecrypted(circ *Circuit, cell Cell, msgs []*RelayMessage) ActionableError {
+	for _, msg := range msgs {
+		var err ActionableError
+		if msg.Command() == RELAY_DATA {
+			// Flow control is per leg, even when the data belongs to another one
+			err = c.noteDataReceived(circ)
+		}
+		if err == nil {
+			if circ.conflux != nil && confluxMultiplexed(msg.Command()) {
+				err = c.confluxReceive(circ, msg)
+			} else {
+				err = c.handleRelayMessage(circ, cell, msg)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *OnionConnection) handleRelayDecrypted(circ *Circuit, cell Cell, rcell *RelayCell) ActionableError {
+func (c *OnionConnection) handleRelayMessage(circ *Circuit, cell Cell, msg *RelayMessage) ActionableError {
 	var err ActionableError
 
-	// At this point we established that the rcell is intended for us
-	switch rcell.Command() {
+	// At this point we established that the message is intended for us
+	switch msg.Command() {
 	case RELAY_DATA:
-		err = c.handleRelayData(circ, rcell)
+		err = c.handleRelayData(circ, msg)
 	case RELAY_END:
-		err = c.handleRelayEnd(circ, rcell)
+		err = c.handleRelayEnd(circ, msg)
 	case RELAY_SENDME:
-		err = c.handleRelaySendme(circ, rcell)
+		err = c.handleRelaySendme(circ, msg)
+	case RELAY_XOFF:
+		err = c.handleRelayXoff(circ, msg)
+	case RELAY_XON:
+		err = c.handleRelayXon(circ, msg)
 	case RELAY_BEGIN_DIR, RELAY_BEGIN:
-		err = c.handleRelayBegin(circ, rcell)
+		err = c.handleRelayBegin(circ, msg)
 	case RELAY_EXTEND:
 		if cell.Command() == CMD_RELAY {
 			err = CloseCircuit(errors.New("RELAY may not have an EXTEND command"), DESTROY_REASON_PROTOCOL)
 			break
 		}
-		err = c.handleRelayExtend(circ, rcell)
+		err = c.handleRelayExtend(circ, msg)
 	case RELAY_EXTEND2:
 		if cell.Command() == CMD_RELAY {
 			err = CloseCircuit(errors.New("RELAY may not have an EXTEND command"), DESTROY_REASON_PROTOCOL)
 			break
 		}
-		err = c.handleRelayExtend2(circ, rcell)
+		err = c.handleRelayExtend2(circ, msg)
 	case RELAY_RESOLVE:
-		err = c.handleRelayResolve(circ, rcell)
+		err = c.handleRelayResolve(circ, msg)
+	case RELAY_CONFLUX_LINK:
+		err = c.handleRelayConfluxLink(circ, msg)
+	case RELAY_CONFLUX_LINKED_ACK:
+		err = c.handleRelayConfluxLinkedAck(circ, msg)
+	case RELAY_CONFLUX_SWITCH:
+		err = c.handleRelayConfluxSwitch(circ, msg)
 	case RELAY_DROP:
 		// Ignore
 	default:
-		err = CloseCircuit(fmt.Errorf("Don't know a command %s: %v", rcell.Command(), rcell), DESTROY_REASON_PROTOCOL)
+		err = CloseCircuit(fmt.Errorf("Don't know a command %s: %v", msg.Command(), msg), DESTROY_REASON_PROTOCOL)
 	}
 
 	if err != nil {
 		switch err.Handle() {
 		case ERROR_CLOSE_STREAM, ERROR_REFUSE_STREAM:
-			streamID := rcell.StreamID()
+			streamID := msg.StreamID()
 			if streamID == 0 {
 				err = CloseConnection(fmt.Errorf("Got a ERROR_REFUSE_STREAM for StreamID=0. Original error: %s", err))
 				break
@@ -158,30 +175,58 @@ func (c *OnionConnection) handleRelayDecrypted(circ *Circuit, cell Cell, rcell *
 	return err
 }
 
-func (c *OnionConnection) handleRelayBegin(circ *Circuit, cell *RelayCell) ActionableError {
-	streamID := cell.StreamID()
-	isDir := cell.Command() == RELAY_BEGIN_DIR
+func (c *OnionConnection) handleRelayBegin(circ *Circuit, msg *RelayMessage) ActionableError {
+	streamID := msg.StreamID()
+	isDir := msg.Command() == RELAY_BEGIN_DIR
 
-	_, alreadyExists := circ.streams[streamID]
-	if alreadyExists {
-		return CloseCircuit(errors.New("We already have a stream with that ID"), DESTROY_REASON_PROTOCOL)
+	if old, alreadyExists := circ.streams[streamID]; alreadyExists {
+		if !old.endSent {
+			return CloseCircuit(errors.New("We already have a stream with that ID"), DESTROY_REASON_PROTOCOL)
+		}
+
+		// We sent END, so as far as the client knows the ID is free again
+		delete(circ.streams, streamID)
+		old.Destroy()
 	}
 
-	if isDir && c.parentOR.config.DirPort == 0 {
-		return RefuseStream(errors.New("We're no directory."), STREAM_REASON_NOTDIRECTORY)
+	if isDir {
+		// Served in-process, see directory.go
+		Log(LOG_CIRC, "Opening directory stream")
+
+		stream, err := NewStream(streamID, circ.cc != nil)
+		if err != nil {
+			return RefuseStream(err, STREAM_REASON_INTERNAL)
+		}
+		if err := c.admitStream(circ, stream, false); err != nil {
+			return err
+		}
+
+		circ.streams[streamID] = stream
+		stream.SetRoute(circ.id, c.circuitReadQueue, circ.conflux)
+		stream.account = circ.queue
+		go stream.Run(circ.backwardWindow, "directory", 0, 0, &c.parentOR.directory, c.parentOR.config)
+
+		return nil
 	}
 
 	var addr string
-	if isDir {
-		addr = fmt.Sprintf("127.0.0.1:%d", c.parentOR.config.DirPort)
-	} else {
-		for i := 0; i < cell.Length(); i++ {
-			if cell.Data()[i] == 0 {
-				addr = string(cell.Data()[0:i])
-				break
+	var flags uint32
+	data := msg.Data()
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0 {
+			addr = string(data[0:i])
+			if len(data) >= i+5 {
+				flags = BigEndian.Uint32(data[i+1 : i+5])
 			}
+			break
 		}
-		// XXX handle flags
+	}
+
+	if !c.parentOR.config.IPv6Exit {
+		flags &^= BEGIN_FLAG_IPV6_OK | BEGIN_FLAG_IPV6_PREFERRED
+	}
+	if flags&BEGIN_FLAG_IPV4_NOT_OK != 0 && flags&BEGIN_FLAG_IPV6_OK == 0 {
+		return RefuseStream(errors.New("Stream allows neither IPv4 nor IPv6"), STREAM_REASON_EXITPOLICY)
 	}
 
 	if addr == "" {
@@ -200,27 +245,39 @@ func (c *OnionConnection) handleRelayBegin(circ *Circuit, cell *RelayCell) Actio
 
 	Log(LOG_CIRC, "Opening stream to %s", addr)
 
-	stream, err := NewStream(streamID)
+	stream, err := NewStream(streamID, circ.cc != nil)
 	if err != nil {
 		return RefuseStream(err, STREAM_REASON_INTERNAL)
 	}
+	if err := c.admitStream(circ, stream, true); err != nil {
+		return err
+	}
 
 	circ.streams[streamID] = stream
-	go stream.Run(circ.id, circ.backwardWindow, c.circuitReadQueue, matches[1], uint16(port), isDir, c.parentOR.config.ExitPolicy)
+	stream.SetRoute(circ.id, c.circuitReadQueue, circ.conflux)
+	stream.account = circ.queue
+	host := strings.TrimSuffix(strings.TrimPrefix(matches[1], "["), "]")
+	go stream.Run(circ.backwardWindow, host, uint16(port), flags, nil, c.parentOR.config)
 
 	return nil
 }
 
 func (c *OnionConnection) sendRelayCell(circ *Circuit, stream StreamID, direction DataDirection, command RelayCommand, data []byte) ActionableError {
-	if len(data) > MAX_RELAY_LEN {
-		panic("Somehow we're trying to send a massive cell")
+	if circ.conflux != nil && direction == BackwardDirection && confluxMultiplexed(command) {
+		return c.confluxSend(circ, stream, command, data)
 	}
+	return c.sendRelayCellOn(circ, stream, direction, command, data)
+}
 
-	var crypto DirectionalCircuitState // XXX When would forward be relevant here?
+// Sends the message on this circuit, even if it is part of a conflux set
+func (c *OnionConnection) sendRelayCellOn(circ *Circuit, stream StreamID, direction DataDirection, command RelayCommand, data []byte) ActionableError {
+	crypto := circ.backward // XXX When would forward be relevant here?
 	if direction == ForwardDirection {
 		crypto = circ.forward
-	} else {
-		crypto = circ.backward
+	}
+
+	if len(data) > MAX_RELAY_LEN {
+		panic("Somehow we're trying to send a massive cell")
 	}
 
 	cell := NewCell(c.negotiatedVersion, circ.id, CMD_RELAY, nil)
@@ -232,30 +289,22 @@ func (c *OnionConnection) sendRelayCell(circ *Circuit, stream StreamID, directio
 	buf[2] = 0
 	BigEndian.PutUint16(buf[3:5], uint16(stream))
 
-	// placeholder for digest
-
 	if data != nil && len(data) != 0 {
 		BigEndian.PutUint16(buf[9:11], uint16(len(data)))
 		copy(buf[11:], data)
 	}
 
-	crypto.digest.Write(buf)
-	digest := crypto.digest.Sum(nil)
-	buf[5] = digest[0]
-	buf[6] = digest[1]
-	buf[7] = digest[2]
-	buf[8] = digest[3]
+	crypto.Originate(buf)
 
-	// Now AES it
-	crypto.cipher.Crypt(buf, buf)
-
-	c.writeQueue <- cell.Bytes() // XXX this could deadlock
+	if command == RELAY_DATA && direction == BackwardDirection {
+		circ.recordDataDigest(crypto.LastTag())
+	}
 
-	return nil
+	return c.queueCircuitWrite(circ.cells, cell.Bytes())
 }
 
-func (c *OnionConnection) handleRelayEnd(circ *Circuit, cell *RelayCell) ActionableError {
-	streamID := cell.StreamID()
+func (c *OnionConnection) handleRelayEnd(circ *Circuit, msg *RelayMessage) ActionableError {
+	streamID := msg.StreamID()
 	stream, ok := circ.streams[streamID]
 	if !ok {
 		Log(LOG_INFO, "Ignoring RELAY_END for non-existent stream")
@@ -268,59 +317,100 @@ func (c *OnionConnection) handleRelayEnd(circ *Circuit, cell *RelayCell) Actiona
 	return nil
 }
 
-func (c *OnionConnection) handleRelaySendme(circ *Circuit, cell *RelayCell) ActionableError {
-	if cell.StreamID() == 0 {
-		circ.backwardWindow.Refill(100)
+func (c *OnionConnection) handleRelaySendme(circ *Circuit, msg *RelayMessage) ActionableError {
+	if msg.StreamID() == 0 {
+		if err := c.checkCircuitSendme(circ, msg.Data()); err != nil {
+			return err
+		}
+
+		if circ.cc == nil {
+			circ.backwardWindow.Refill(CIRCWINDOW_INCREMENT)
+			return nil
+		}
+
+		delta, err := circ.cc.HandleSendme(time.Now())
+		if err != nil {
+			return CloseCircuit(err, DESTROY_REASON_PROTOCOL)
+		}
+		circ.backwardWindow.Refill(delta)
+		circ.confluxNoteSendme()
 	} else {
-		stream, ok := circ.streams[cell.StreamID()]
+		if circ.cc != nil {
+			return CloseCircuit(errors.New("stream-level SENDME on a circuit with congestion control"), DESTROY_REASON_PROTOCOL)
+		}
+
+		stream, ok := circ.streams[msg.StreamID()]
 		if !ok {
 			Log(LOG_CIRC, "Ignoring SENDME for unknown stream")
 			return nil // Sure, that's ok
 		}
 
-		stream.backwardWindow.Refill(50)
+		stream.backwardWindow.Refill(STREAMWINDOW_INCREMENT)
 	}
 	return nil
 }
 
-func (c *OnionConnection) handleRelayData(circ *Circuit, cell *RelayCell) ActionableError {
-	circ.forwardWindow--
-	if circ.forwardWindow <= 900 {
-		if err := c.sendRelayCell(circ, 0, BackwardDirection, RELAY_SENDME, nil); err != nil {
-			return err
+func (c *OnionConnection) noteDataReceived(circ *Circuit) ActionableError {
+	if circ.cc != nil {
+		if circ.cc.NoteCellDelivered() {
+			if err := c.sendCircuitSendme(circ); err != nil {
+				return err
+			}
+		}
+	} else {
+		circ.forwardWindow--
+		if circ.forwardWindow <= CIRCWINDOW_START-CIRCWINDOW_INCREMENT {
+			if err := c.sendCircuitSendme(circ); err != nil {
+				return err
+			}
+			circ.forwardWindow += CIRCWINDOW_INCREMENT
 		}
-		circ.forwardWindow += 100
 	}
+	return nil
+}
 
-	streamID := cell.StreamID()
+func (c *OnionConnection) handleRelayData(circ *Circuit, msg *RelayMessage) ActionableError {
+	streamID := msg.StreamID()
 	stream, ok := circ.streams[streamID]
 	if !ok {
 		Log(LOG_INFO, "ignoring data for stream we don't know")
 		return nil
 	}
 
-	ok = stream.forwardWindow.TryTake()
-	if !ok {
-		return CloseStream(errors.New("Refusing to overflow window"), STREAM_REASON_TORPROTOCOL)
+	if stream.flowControl {
+		// They should have stopped when we sent XOFF
+		if len(stream.writeChan) == cap(stream.writeChan) {
+			return CloseStream(errors.New("Refusing to overflow stream buffer"), STREAM_REASON_RESOURCELIMIT)
+		}
+	} else {
+		ok = stream.forwardWindow.TryTake()
+		if !ok {
+			return CloseStream(errors.New("Refusing to overflow window"), STREAM_REASON_TORPROTOCOL)
+		}
+	}
+
+	data := msg.Data()
+	if len(data) > MAX_RELAY_LEN {
+		return CloseCircuit(errors.New("DATA message does not fit in a cell"), DESTROY_REASON_PROTOCOL)
 	}
 
-	data := cell.Data()
 	// gotta copy that
 	dataCopy := GetCellBuf(false)
 	copy(dataCopy, data)
 
+	stream.account.Add()
 	stream.writeChan <- dataCopy[0:len(data)]
 
 	return nil
 }
 
-func (c *OnionConnection) handleRelayResolve(circ *Circuit, cell *RelayCell) ActionableError {
-	stream := cell.StreamID()
+func (c *OnionConnection) handleRelayResolve(circ *Circuit, msg *RelayMessage) ActionableError {
+	stream := msg.StreamID()
 	if stream == 0 {
 		return CloseCircuit(errors.New("No Circuit ID for RELAY_RESOLVE"), DESTROY_REASON_PROTOCOL)
 	}
 
-	data := cell.Data()
+	data := msg.Data()
 	var firstZero int
 	for i, ch := range data {
 		if ch == 0 {
@@ -333,7 +423,7 @@ func (c *OnionConnection) handleRelayResolve(circ *Circuit, cell *RelayCell) Act
 	}
 
 	dnsName := string(data[:firstZero])
-	ResolveDNSAsync(dnsName, circ.id, stream, c.circuitReadQueue)
+	ResolveDNSAsync(dnsName, c.parentOR.config.IPv6Exit, circ.id, stream, c.circuitReadQueue)
 
 	return nil
 }
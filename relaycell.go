@@ -37,3 +37,43 @@ func (c *RelayCell) Length() int {
 func (c *RelayCell) Data() []byte {
 	return c.bytes[11 : 11+c.Length()]
 }
+
+// The commands that are about a stream. Conflux puts these in order
+func relayCommandHasStreamID(cmd RelayCommand) bool {
+	switch cmd {
+	case RELAY_BEGIN, RELAY_DATA, RELAY_END, RELAY_CONNECTED, RELAY_RESOLVE, RELAY_RESOLVED, RELAY_BEGIN_DIR, RELAY_XOFF, RELAY_XON:
+		return true
+	}
+	return false
+}
+
+type RelayMessage struct {
+	command  RelayCommand
+	streamID StreamID
+	data     []byte
+}
+
+func (m *RelayMessage) Command() RelayCommand {
+	return m.command
+}
+
+func (m *RelayMessage) StreamID() StreamID {
+	return m.streamID
+}
+
+func (m *RelayMessage) Length() int {
+	return len(m.data)
+}
+
+func (m *RelayMessage) Data() []byte {
+	return m.data
+}
+
+// The message in a v0 cell. It shares the cell's buffer
+func (c *RelayCell) Message() *RelayMessage {
+	return &RelayMessage{
+		command:  c.Command(),
+		streamID: c.StreamID(),
+		data:     c.Data(),
+	}
+}
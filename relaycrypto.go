@@ -0,0 +1,99 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/tvdw/gotor/aes"
+	"github.com/tvdw/gotor/sha1"
+)
+
+// The relay cell crypto for one direction of our hop on a circuit. All methods work in place on a cell body.
+type DirectionalCircuitState interface {
+	// Removes our layer from a cell coming from the client. Returns whether the cell is meant for us
+	Decrypt(cell []byte) bool
+
+	// Encrypts a cell we made ourselves, for the client
+	Originate(cell []byte)
+
+	// Adds our layer to a cell from further down the circuit
+	Relay(cell []byte)
+
+	// Identifies the last cell we recognized or originated. Authenticated SENDMEs echo it
+	LastTag() []byte
+}
+
+var zeroIv [16]byte
+
+// The original relay crypto: AES-128-CTR with a running SHA-1 digest to recognize cells
+type tor1CircuitState struct {
+	cipher  aes.Cipher
+	digest  *sha1.Digest
+	lastTag []byte
+}
+
+func newTor1CircuitState(seed, key []byte) *tor1CircuitState {
+	digest := sha1.New()
+	digest.Write(seed)
+
+	return &tor1CircuitState{
+		cipher: aes.New(key, zeroIv[:]),
+		digest: digest,
+	}
+}
+
+func (s *tor1CircuitState) Decrypt(cell []byte) bool {
+	s.cipher.Crypt(cell, cell)
+
+	rcell := RelayCell{cell}
+	if !rcell.Recognized() {
+		return false
+	}
+
+	tmpCell := GetCellBuf(false)
+	defer ReturnCellBuf(tmpCell)
+	copy(tmpCell, cell)
+	tmpCell = tmpCell[:len(cell)]
+	tmpCell[5] = 0
+	tmpCell[6] = 0
+	tmpCell[7] = 0
+	tmpCell[8] = 0
+
+	old_dig := s.digest.Clone() // XXX rofl
+
+	s.digest.Write(tmpCell)
+	their_digest := rcell.Digest()
+	our_digest := s.digest.Sum(nil)
+	if their_digest[0] != our_digest[0] || their_digest[1] != our_digest[1] || their_digest[2] != our_digest[2] || their_digest[3] != our_digest[3] {
+		s.digest = old_dig // XXX Find a better way to do this :-)
+		return false
+	}
+
+	s.lastTag = our_digest
+	return true
+}
+
+func (s *tor1CircuitState) Originate(cell []byte) {
+	// placeholder for digest
+	cell[5] = 0
+	cell[6] = 0
+	cell[7] = 0
+	cell[8] = 0
+
+	s.digest.Write(cell)
+	digest := s.digest.Sum(nil)
+	copy(cell[5:9], digest)
+	s.lastTag = digest
+
+	// Now AES it
+	s.cipher.Crypt(cell, cell)
+}
+
+func (s *tor1CircuitState) Relay(cell []byte) {
+	s.cipher.Crypt(cell, cell)
+}
+
+func (s *tor1CircuitState) LastTag() []byte {
+	return s.lastTag
+}
@@ -9,6 +9,7 @@ type RelayData struct {
 	data     []byte
 	forRelay bool
 	rType    Command
+	account  *QueueAccount // Of the circuit that queued this
 }
 
 func (c *RelayData) CircID() CircuitID {
@@ -24,23 +25,17 @@ func (rdata *RelayData) Handle(c *OnionConnection, circ *Circuit) ActionableErro
 
 	cell := NewCell(c.negotiatedVersion, circ.id, CMD_RELAY, nil)
 
-	cstate := circ.backward.cipher
-	_, err := cstate.Crypt(data, cell.Data())
-	if err != nil {
-		cell.ReleaseBuffers()
-		return CloseCircuit(err, DESTROY_REASON_INTERNAL)
-	}
+	copy(cell.Data(), data)
+	circ.backward.Relay(cell.Data())
 
-	c.writeQueue <- cell.Bytes()
-	return nil
+	return c.queueCircuitWrite(circ.cells, cell.Bytes())
 }
 
 func (data *RelayData) HandleRelay(c *OnionConnection, circ *RelayCircuit) ActionableError {
-	c.writeQueue <- NewCell(c.negotiatedVersion, circ.id, data.rType, data.data).Bytes()
-
-	return nil
+	return c.queueCircuitWrite(circ.cells, NewCell(c.negotiatedVersion, circ.id, data.rType, data.data).Bytes())
 }
 
 func (data *RelayData) ReleaseBuffers() {
+	data.account.Remove()
 	ReturnCellBuf(data.data)
 }
@@ -0,0 +1,319 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/heap"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	RESOLV_CONF            = "/etc/resolv.conf"
+	RESOLVER_TIMEOUT       = 5 * time.Second // Per nameserver
+	RESOLVER_CACHE_SIZE    = 10000
+	RESOLVER_NEGATIVE_TTL  = 5 * time.Minute // When the answer doesn't come with an SOA record
+	RESOLVER_MAX_CACHE_TTL = 24 * time.Hour
+
+	// Clients only ever see one of these two TTLs, see clipDNSTTL
+	MIN_DNS_TTL = 5 * 60
+	MAX_DNS_TTL = 60 * 60
+)
+
+// Answer types in RELAY_RESOLVED, besides the 4 and 6 of addresses
+const (
+	DNS_ANSWER_HOSTNAME    byte = 0x00
+	DNS_ERROR_TRANSIENT    byte = 0xF0
+	DNS_ERROR_NONTRANSIENT byte = 0xF1
+)
+
+// The resolver shared by all exit streams and RELAY_RESOLVEs. Lookups for the same name and type share one query,
+// and answers are cached for as long as their TTL says.
+type Resolver struct {
+	servers           []string
+	client, tcpClient dns.Client
+
+	lock     sync.Mutex
+	cache    map[resolverKey]*resolverEntry
+	expiry   resolverExpiryHeap // The cached entries, the one that expires first on top
+	inflight map[resolverKey]*resolverLookup
+}
+
+type resolverKey struct {
+	name  string
+	qtype uint16
+}
+
+type resolverEntry struct {
+	results []DNSAddress // nil for a negative answer
+	expires time.Time
+
+	key   resolverKey
+	index int // In the expiry heap
+}
+
+type resolverExpiryHeap []*resolverEntry
+
+func (h resolverExpiryHeap) Len() int           { return len(h) }
+func (h resolverExpiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h resolverExpiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *resolverExpiryHeap) Push(x interface{}) {
+	e := x.(*resolverEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *resolverExpiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+type resolverLookup struct {
+	done    chan struct{}
+	results []DNSAddress
+	err     byte
+	errTTL  int // How long a negative answer is good for
+}
+
+var resolverOnce sync.Once
+var resolver *Resolver
+
+func getResolver() *Resolver {
+	resolverOnce.Do(func() {
+		var servers []string
+		conf, err := dns.ClientConfigFromFile(RESOLV_CONF)
+		if err != nil || len(conf.Servers) == 0 {
+			Log(LOG_WARN, "Could not load nameservers from %s, using localhost: %v", RESOLV_CONF, err)
+			servers = []string{"127.0.0.1:53"}
+		} else {
+			for _, server := range conf.Servers {
+				servers = append(servers, net.JoinHostPort(server, conf.Port))
+			}
+		}
+		resolver = NewResolver(servers)
+	})
+	return resolver
+}
+
+func NewResolver(servers []string) *Resolver {
+	return &Resolver{
+		servers:   servers,
+		client:    dns.Client{Timeout: RESOLVER_TIMEOUT},
+		tcpClient: dns.Client{Net: "tcp", Timeout: RESOLVER_TIMEOUT},
+		cache:     make(map[resolverKey]*resolverEntry),
+		inflight:  make(map[resolverKey]*resolverLookup),
+	}
+}
+
+// Looks up the A and AAAA records of a host in parallel. Errors are reported as a single DNSAddress of type
+// DNS_ERROR_TRANSIENT or DNS_ERROR_NONTRANSIENT.
+func (r *Resolver) Lookup(host string, ipv4, ipv6 bool) []DNSAddress {
+	var qtypes []uint16
+	if ipv4 {
+		qtypes = append(qtypes, dns.TypeA)
+	}
+	if ipv6 {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+
+	return r.resolve(host, qtypes...)
+}
+
+// Looks up the hostname for an in-addr.arpa or ip6.arpa name. Answers are of type DNS_ANSWER_HOSTNAME.
+func (r *Resolver) LookupPTR(name string) []DNSAddress {
+	return r.resolve(name, dns.TypePTR)
+}
+
+func (r *Resolver) resolve(name string, qtypes ...uint16) []DNSAddress {
+	lookups := make([]*resolverLookup, len(qtypes))
+	for i, qtype := range qtypes {
+		lookups[i] = r.lookup(resolverKey{strings.ToLower(dns.Fqdn(name)), qtype})
+	}
+
+	var results []DNSAddress
+	errType := DNS_ERROR_NONTRANSIENT
+	errTTL := -1
+	for _, l := range lookups {
+		<-l.done
+		results = append(results, l.results...)
+		if l.err == DNS_ERROR_TRANSIENT {
+			errType = DNS_ERROR_TRANSIENT
+		}
+		if l.err == DNS_ERROR_NONTRANSIENT && (errTTL < 0 || l.errTTL < errTTL) {
+			errTTL = l.errTTL
+		}
+	}
+
+	if len(results) == 0 {
+		if errType == DNS_ERROR_TRANSIENT || errTTL < 0 {
+			errTTL = 0 // We didn't cache it either
+		}
+		return []DNSAddress{DNSAddress{errType, errTTL, nil}}
+	}
+	return results
+}
+
+func (r *Resolver) lookup(key resolverKey) *resolverLookup {
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if entry, ok := r.cache[key]; ok {
+		if entry.expires.After(now) {
+			l := &resolverLookup{done: make(chan struct{})}
+			l.results = entry.ttlAdjusted(now)
+			if l.results == nil {
+				l.err = DNS_ERROR_NONTRANSIENT
+				l.errTTL = int(entry.expires.Sub(now) / time.Second)
+			}
+			close(l.done)
+			return l
+		}
+		r.forget(entry)
+	}
+
+	if l, ok := r.inflight[key]; ok {
+		return l
+	}
+
+	l := &resolverLookup{done: make(chan struct{})}
+	r.inflight[key] = l
+	go r.run(key, l)
+	return l
+}
+
+// The cached records, with the TTLs they have left
+func (e *resolverEntry) ttlAdjusted(now time.Time) []DNSAddress {
+	if e.results == nil {
+		return nil
+	}
+	results := make([]DNSAddress, len(e.results))
+	left := int(e.expires.Sub(now) / time.Second)
+	for i, a := range e.results {
+		results[i] = a
+		if results[i].TTL > left {
+			results[i].TTL = left
+		}
+	}
+	return results
+}
+
+func (r *Resolver) run(key resolverKey, l *resolverLookup) {
+	results, ttl, err := r.query(key)
+	if ttl > RESOLVER_MAX_CACHE_TTL {
+		ttl = RESOLVER_MAX_CACHE_TTL
+	}
+	l.results = results
+	l.err = err
+	l.errTTL = int(ttl / time.Second)
+
+	r.lock.Lock()
+	delete(r.inflight, key)
+	if err != DNS_ERROR_TRANSIENT && ttl > 0 {
+		r.store(key, &resolverEntry{results: results, expires: time.Now().Add(ttl)})
+	}
+	r.lock.Unlock()
+
+	close(l.done)
+}
+
+// Must be called with the lock held. When the cache is full, the entry that expires first makes room.
+func (r *Resolver) store(key resolverKey, entry *resolverEntry) {
+	if old, ok := r.cache[key]; ok {
+		r.forget(old)
+	}
+	if len(r.cache) >= RESOLVER_CACHE_SIZE {
+		r.forget(r.expiry[0])
+	}
+
+	entry.key = key
+	r.cache[key] = entry
+	heap.Push(&r.expiry, entry)
+}
+
+// Must be called with the lock held
+func (r *Resolver) forget(entry *resolverEntry) {
+	delete(r.cache, entry.key)
+	heap.Remove(&r.expiry, entry.index)
+}
+
+// Asks the nameservers in turn until one of them gives a usable answer. Returns the records, how long the
+// answer may be cached for, and an error type if there were no records.
+func (r *Resolver) query(key resolverKey) ([]DNSAddress, time.Duration, byte) {
+	m := new(dns.Msg)
+	m.SetQuestion(key.name, key.qtype)
+
+	for _, server := range r.servers {
+		in, _, err := r.client.Exchange(m, server)
+		if err == nil && in.Truncated {
+			in, _, err = r.tcpClient.Exchange(m, server)
+		}
+		if err != nil {
+			Log(LOG_INFO, "DNS query for %s to %s failed: %s", key.name, server, err)
+			continue
+		}
+
+		switch in.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+		default:
+			// SERVFAIL, REFUSED and friends: maybe the next one does better
+			continue
+		}
+
+		var results []DNSAddress
+		var minTTL uint32
+		for _, answer := range in.Answer {
+			var a DNSAddress
+			switch rr := answer.(type) {
+			case *dns.A:
+				a = DNSAddress{Type: 4, TTL: int(rr.Hdr.Ttl), Value: []byte(rr.A.To4())}
+			case *dns.AAAA:
+				a = DNSAddress{Type: 6, TTL: int(rr.Hdr.Ttl), Value: []byte(rr.AAAA.To16())}
+			case *dns.PTR:
+				a = DNSAddress{Type: DNS_ANSWER_HOSTNAME, TTL: int(rr.Hdr.Ttl), Value: []byte(strings.TrimSuffix(rr.Ptr, "."))}
+			default:
+				continue // CNAMEs and such
+			}
+			if len(results) == 0 || answer.Header().Ttl < minTTL {
+				minTTL = answer.Header().Ttl
+			}
+			results = append(results, a)
+		}
+
+		if len(results) != 0 {
+			return results, time.Duration(minTTL) * time.Second, 0
+		}
+		return nil, negativeTTL(in), DNS_ERROR_NONTRANSIENT
+	}
+
+	return nil, 0, DNS_ERROR_TRANSIENT
+}
+
+// RFC 2308: negative answers are cached for the SOA's minimum TTL
+func negativeTTL(in *dns.Msg) time.Duration {
+	for _, rr := range in.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return RESOLVER_NEGATIVE_TTL
+}
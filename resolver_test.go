@@ -0,0 +1,124 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func startTestNameserver(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestResolver(t *testing.T) {
+	var queries int32
+	addr, stop := startTestNameserver(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(50 * time.Millisecond)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Name == "example.com." && q.Qtype == dns.TypeA:
+			rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		case q.Name == "example.com." && q.Qtype == dns.TypeAAAA:
+			rr, _ := dns.NewRR("example.com. 60 IN AAAA 2001:db8::1")
+			m.Answer = append(m.Answer, rr)
+		case q.Name == "1.2.0.192.in-addr.arpa." && q.Qtype == dns.TypePTR:
+			rr, _ := dns.NewRR("1.2.0.192.in-addr.arpa. 120 IN PTR example.com.")
+			m.Answer = append(m.Answer, rr)
+		default:
+			m.Rcode = dns.RcodeNameError
+			soa, _ := dns.NewRR("example. 900 IN SOA ns.example. admin.example. 1 7200 3600 86400 600")
+			m.Ns = append(m.Ns, soa)
+		}
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	// The first server doesn't answer at all
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	r := NewResolver([]string{dead.LocalAddr().String(), addr})
+	r.client.Timeout = 200 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := r.Lookup("Example.com", true, true)
+			if len(res) != 2 || res[0].Type != 4 || res[1].Type != 6 || res[1].TTL != 60 {
+				t.Errorf("unexpected results %v", res)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("expected the lookups to share 2 queries, got %d", n)
+	}
+
+	if res := r.Lookup("example.com", true, false); len(res) != 1 || res[0].Type != 4 {
+		t.Errorf("unexpected cached results %v", res)
+	}
+	if res := r.Lookup("nope.example", true, false); len(res) != 1 || res[0].Type != DNS_ERROR_NONTRANSIENT || res[0].TTL != 600 {
+		t.Errorf("expected a nonexistent name, got %v", res)
+	}
+	r.Lookup("nope.example", true, false)
+	if n := atomic.LoadInt32(&queries); n != 3 {
+		t.Errorf("expected answers to come from the cache, got %d queries", n)
+	}
+
+	if !isReverseName("1.2.0.192.IN-ADDR.ARPA") || isReverseName("in-addr.arpa.example.com") {
+		t.Error("isReverseName is wrong")
+	}
+	res := r.LookupPTR("1.2.0.192.in-addr.arpa")
+	if len(res) != 1 || res[0].Type != DNS_ANSWER_HOSTNAME || string(res[0].Value) != "example.com" || res[0].TTL != 120 {
+		t.Errorf("unexpected PTR results %v", res)
+	}
+}
+
+func TestResolverCacheEviction(t *testing.T) {
+	r := NewResolver(nil)
+	now := time.Now()
+
+	r.lock.Lock()
+	for i := 0; i < RESOLVER_CACHE_SIZE; i++ {
+		key := resolverKey{name: string(rune(i + 1)), qtype: dns.TypeA}
+		r.store(key, &resolverEntry{expires: now.Add(time.Hour + time.Duration(i)*time.Second)})
+	}
+	soonest := resolverKey{name: string(rune(1)), qtype: dns.TypeA}
+	latest := resolverKey{name: "latest.example.", qtype: dns.TypeA}
+	r.store(latest, &resolverEntry{expires: now.Add(2 * time.Hour)})
+
+	_, evicted := r.cache[soonest]
+	_, stored := r.cache[latest]
+	size := len(r.cache)
+	r.lock.Unlock()
+
+	if evicted || !stored || size != RESOLVER_CACHE_SIZE {
+		t.Fatalf("expected the soonest entry to make room, got evicted=%v stored=%v size=%d", evicted, stored, size)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"time"
+)
+
+// Each circuit queues its cells separately, and the connection's writer asks the scheduler which circuit gets to
+// send next. Like Tor's circuitmux_ewma we pick the circuit with the lowest exponentially weighted moving average
+// of cells sent, which favours circuits that have been quiet recently over bulk transfers.
+//
+// Instead of decaying the average of every circuit as time passes, we grow the weight of newly sent cells. The
+// ordering is the same, and we only need to touch every circuit when the numbers get too large.
+
+const EWMA_RESCALE_THRESHOLD = 1e50
+
+// Like Tor's circ_max_cell_queue_size: a circuit with this many cells waiting isn't respecting its windows
+const CIRCUIT_MAX_CELL_QUEUE = 50000
+
+type CircuitQueue struct {
+	account  *QueueAccount
+	cells    [][]byte
+	ewma     float64
+	index    int // In the scheduler's heap, or -1 if we have nothing to send
+	detached bool
+}
+
+type circuitQueueHeap []*CircuitQueue
+
+func (h circuitQueueHeap) Len() int           { return len(h) }
+func (h circuitQueueHeap) Less(i, j int) bool { return h[i].ewma < h[j].ewma }
+func (h circuitQueueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *circuitQueueHeap) Push(x interface{}) {
+	q := x.(*CircuitQueue)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+
+func (h *circuitQueueHeap) Pop() interface{} {
+	old := *h
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	q.index = -1
+	return q
+}
+
+type CircuitScheduler struct {
+	lock     sync.Mutex
+	active   circuitQueueHeap
+	queues   map[*CircuitQueue]struct{}
+	halflife time.Duration
+	base     time.Time
+
+	// Receives a value whenever cells get queued
+	ready chan struct{}
+}
+
+// A halflife of zero disables the decay, so circuits are simply ordered by the number of cells they sent
+func NewCircuitScheduler(halflife time.Duration) *CircuitScheduler {
+	return &CircuitScheduler{
+		queues:   make(map[*CircuitQueue]struct{}),
+		halflife: halflife,
+		base:     time.Now(),
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+func (s *CircuitScheduler) NewQueue(account *QueueAccount) *CircuitQueue {
+	q := &CircuitQueue{
+		account: account,
+		index:   -1,
+	}
+
+	s.lock.Lock()
+	s.queues[q] = struct{}{}
+	s.lock.Unlock()
+
+	return q
+}
+
+// Queues the cell, unless the circuit already has too many. Returns false if it does.
+func (s *CircuitScheduler) Push(q *CircuitQueue, data []byte) bool {
+	s.lock.Lock()
+	if q.detached {
+		s.lock.Unlock()
+		ReturnCellBuf(data)
+		return true
+	}
+	if len(q.cells) >= CIRCUIT_MAX_CELL_QUEUE {
+		s.lock.Unlock()
+		ReturnCellBuf(data)
+		return false
+	}
+
+	q.cells = append(q.cells, data)
+	if q.index < 0 {
+		heap.Push(&s.active, q)
+	}
+	s.lock.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Returns the next cell to write, or nil if no circuit has anything to send
+func (s *CircuitScheduler) Next() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.active) == 0 {
+		return nil
+	}
+
+	q := s.active[0]
+	data := q.cells[0]
+	q.cells[0] = nil
+	q.cells = q.cells[1:]
+	q.account.Remove()
+
+	q.ewma += s.increment(time.Now())
+	if len(q.cells) == 0 {
+		q.cells = nil
+		heap.Remove(&s.active, q.index)
+	} else {
+		heap.Fix(&s.active, q.index)
+	}
+
+	return data
+}
+
+func (s *CircuitScheduler) Pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.active) != 0
+}
+
+// Drops everything the circuit still had queued. The queue cannot be used afterwards
+func (s *CircuitScheduler) Detach(q *CircuitQueue) {
+	if q == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if q.index >= 0 {
+		heap.Remove(&s.active, q.index)
+	}
+	for _, data := range q.cells {
+		ReturnCellBuf(data)
+	}
+	q.cells = nil
+	q.detached = true
+	delete(s.queues, q)
+}
+
+// Must be called with the lock held
+func (s *CircuitScheduler) increment(now time.Time) float64 {
+	if s.halflife == 0 {
+		return 1
+	}
+
+	inc := math.Exp2(float64(now.Sub(s.base)) / float64(s.halflife))
+	if inc > EWMA_RESCALE_THRESHOLD {
+		for q := range s.queues {
+			q.ewma /= inc
+		}
+		s.base = now
+		inc = 1
+		// Dividing everything by the same value keeps the heap ordered
+	}
+	return inc
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerFavoursQuietCircuits(t *testing.T) {
+	s := NewCircuitScheduler(30 * time.Second)
+	bulk := s.NewQueue(nil)
+	quiet := s.NewQueue(nil)
+
+	for i := 0; i < 10; i++ {
+		s.Push(bulk, []byte{'b', byte(i)})
+	}
+	for i := 0; i < 5; i++ {
+		if data := s.Next(); data[0] != 'b' || data[1] != byte(i) {
+			t.Fatalf("expected bulk cell %d, got %v", i, data)
+		}
+	}
+
+	s.Push(quiet, []byte{'q', 0})
+	if data := s.Next(); data[0] != 'q' {
+		t.Fatalf("expected the quiet circuit to go first, got %v", data)
+	}
+
+	// The remaining cells must come out in the order they were queued
+	for i := 5; i < 10; i++ {
+		if data := s.Next(); data[0] != 'b' || data[1] != byte(i) {
+			t.Fatalf("expected bulk cell %d, got %v", i, data)
+		}
+	}
+	if s.Pending() || s.Next() != nil {
+		t.Fatal("scheduler should be empty")
+	}
+}
+
+func TestSchedulerDetach(t *testing.T) {
+	s := NewCircuitScheduler(0)
+	q := s.NewQueue(nil)
+
+	s.Push(q, []byte{1})
+	s.Detach(q)
+	s.Push(q, []byte{2})
+
+	if s.Pending() || s.Next() != nil {
+		t.Fatal("detached queues should not be scheduled")
+	}
+}
+
+func TestSchedulerQueueLimit(t *testing.T) {
+	s := NewCircuitScheduler(0)
+	q := s.NewQueue(nil)
+
+	for i := 0; i < CIRCUIT_MAX_CELL_QUEUE; i++ {
+		if !s.Push(q, []byte{1}) {
+			t.Fatalf("cell %d was refused", i)
+		}
+	}
+	if s.Push(q, []byte{2}) {
+		t.Fatal("queue went over its limit")
+	}
+
+	s.Next()
+	if !s.Push(q, []byte{3}) {
+		t.Fatal("queue did not make room again")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	CIRCWINDOW_START       = 1000
+	CIRCWINDOW_INCREMENT   = 100
+	STREAMWINDOW_START     = 500
+	STREAMWINDOW_INCREMENT = 50
+)
+
+// Authenticated SENDMEs (proposal 289): a circuit-level SENDME echoes the digest of the cell that made the
+// other side send it, proving they actually received our data.
+
+// How many DATA cells a circuit-level SENDME acknowledges
+func (circ *Circuit) sendmeIncrement() int {
+	if circ.cc != nil {
+		return circ.cc.sendmeInc
+	}
+	return CIRCWINDOW_INCREMENT
+}
+
+// Called for every DATA cell we send on a circuit, with the running digest after that cell
+func (circ *Circuit) recordDataDigest(digest []byte) {
+	circ.dataCellsSent++
+	if circ.dataCellsSent%circ.sendmeIncrement() != 0 {
+		return
+	}
+
+	d := make([]byte, len(digest))
+	copy(d, digest)
+	circ.sendmeDigests = append(circ.sendmeDigests, d)
+
+	if circ.cc != nil {
+		circ.cc.NoteSendmeCellSent(time.Now())
+	}
+}
+
+func (c *OnionConnection) checkCircuitSendme(circ *Circuit, data []byte) ActionableError {
+	if len(circ.sendmeDigests) == 0 {
+		return CloseCircuit(errors.New("got a SENDME but we did not expect one"), DESTROY_REASON_PROTOCOL)
+	}
+	expected := circ.sendmeDigests[0]
+	circ.sendmeDigests = circ.sendmeDigests[1:]
+
+	version := byte(0)
+	if len(data) != 0 {
+		version = data[0]
+	}
+
+	switch version {
+	case 0:
+		if c.parentOR.config.SendMeAcceptMinVersion > 0 {
+			return CloseCircuit(errors.New("refusing an unauthenticated SENDME"), DESTROY_REASON_PROTOCOL)
+		}
+		return nil
+
+	case 1:
+		if len(data) < 3 {
+			return CloseCircuit(errors.New("malformed SENDME"), DESTROY_REASON_PROTOCOL)
+		}
+		dataLen := int(BigEndian.Uint16(data[1:3]))
+		if dataLen != len(expected) || len(data) < 3+dataLen {
+			return CloseCircuit(errors.New("malformed SENDME"), DESTROY_REASON_PROTOCOL)
+		}
+		if !bytes.Equal(data[3:3+dataLen], expected) {
+			return CloseCircuit(errors.New("SENDME digest does not match"), DESTROY_REASON_PROTOCOL)
+		}
+		return nil
+
+	default:
+		return CloseCircuit(fmt.Errorf("unknown SENDME version %d", version), DESTROY_REASON_PROTOCOL)
+	}
+}
+
+func (c *OnionConnection) sendCircuitSendme(circ *Circuit) ActionableError {
+	tag := circ.forward.LastTag()
+	if c.parentOR.config.SendMeEmitMinVersion < 1 || tag == nil {
+		return c.sendRelayCell(circ, 0, BackwardDirection, RELAY_SENDME, nil)
+	}
+
+	payload := make([]byte, 3+len(tag))
+	payload[0] = 1
+	BigEndian.PutUint16(payload[1:3], uint16(len(tag)))
+	copy(payload[3:], tag)
+
+	return c.sendRelayCell(circ, 0, BackwardDirection, RELAY_SENDME, payload)
+}
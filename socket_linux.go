@@ -0,0 +1,72 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// KIST: instead of handing the kernel everything we have, we only write what the socket can send soon. The rest
+// stays in the circuit queues, where the scheduler can still reorder it.
+
+type socketMonitor struct {
+	raw syscall.RawConn
+}
+
+func newSocketMonitor(conn net.Conn) *socketMonitor {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return &socketMonitor{}
+	}
+
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return &socketMonitor{}
+	}
+
+	return &socketMonitor{raw: raw}
+}
+
+// Returns how many bytes we should write to the socket right now
+func (s *socketMonitor) WriteBudget() int {
+	if s.raw == nil {
+		return UNLIMITED_WRITE_BUDGET
+	}
+
+	var info *unix.TCPInfo
+	var notSent int
+	var err error
+	ctrlErr := s.raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil {
+			return
+		}
+		notSent, err = unix.IoctlGetInt(int(fd), unix.SIOCOUTQNSD)
+	})
+	if ctrlErr != nil || err != nil {
+		return UNLIMITED_WRITE_BUDGET
+	}
+
+	cwnd := int(info.Snd_cwnd)
+	unacked := int(info.Unacked)
+	mss := int(info.Snd_mss)
+
+	// What fits in the congestion window, plus one more window's worth of unsent data so the kernel doesn't run dry
+	tcpSpace := 0
+	if cwnd > unacked {
+		tcpSpace = (cwnd - unacked) * mss
+	}
+	extraSpace := cwnd*mss - notSent
+	if extraSpace < 0 {
+		extraSpace = 0
+	}
+
+	return tcpSpace + extraSpace
+}
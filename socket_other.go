@@ -0,0 +1,25 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// We can only inspect sockets on Linux. Elsewhere we write whatever we have and let the kernel buffer it.
+
+type socketMonitor struct {
+}
+
+func newSocketMonitor(conn net.Conn) *socketMonitor {
+	return &socketMonitor{}
+}
+
+func (s *socketMonitor) WriteBudget() int {
+	return UNLIMITED_WRITE_BUDGET
+}
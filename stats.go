@@ -14,6 +14,12 @@ const (
 	STATCTR_CIRC_CREATE
 	STATCTR_CIRC_DESTROY
 	STATCTR_CIRC_CURRENT
+	STATCTR_CIRC_TIMEOUT_IDLE
+	STATCTR_CIRC_TIMEOUT_EXTEND
+	STATCTR_CIRC_TIMEOUT_LIFETIME
+	STATCTR_DOS_CONN_REJECTED
+	STATCTR_DOS_CIRC_REFUSED
+	STATCTR_DOS_CLIENTS_MARKED
 
 	STATCTR_COUNT // must be last
 )
@@ -5,8 +5,12 @@
 package main
 
 import (
-	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
+	"net/http"
+	"strconv"
 	"sync/atomic"
 	"time"
 )
@@ -17,13 +21,77 @@ const (
 	STREAM_CONNECTED StreamMessageType = iota
 	STREAM_DISCONNECTED
 	STREAM_SENDME
+	STREAM_XOFF
+	STREAM_XON
+	STREAM_HALF_CLOSED
 )
 
+// How long a half-closed stream may stay quiet before we close it entirely, in either direction
+const STREAM_LINGER_TIMEOUT = 10 * time.Second
+
 type Stream struct {
 	id                            StreamID
 	writeChan                     chan []byte
 	forwardWindow, backwardWindow *Window
 	finished                      int32
+
+	// Why the reader stopped. Only valid once it closed its queue
+	readErr error
+
+	// Set once we sent RELAY_END, but are still accepting data. Owned by the circuit
+	endSent bool
+
+	// Uses XON/XOFF instead of SENDMEs. The windows are then only used to pause the reader
+	flowControl bool
+
+	// Where the stream's messages go, a *streamRoute
+	route atomic.Value
+
+	// The circuit's queue account, for what we queue in either direction
+	account *QueueAccount
+
+	// Numbers the stream's messages, so that they can be put back in order if the stream moves to another circuit
+	sentSeq uint64
+
+	// Owned by the circuit: the last message it handled, and the ones that came in before their turn
+	handledSeq uint64
+	early      map[uint64]streamCommand
+
+	// Stream counts we are part of, released when we stop running. See streamlimit.go
+	counters []*int32
+}
+
+type streamRoute struct {
+	circID CircuitID
+	queue  CircReadQueue
+	leg    *confluxLeg // Set if the circuit is the home leg of a conflux set, which may hand us to another leg
+}
+
+type streamCommand interface {
+	CircuitCommand
+	origin() *streamOrigin
+	handleInOrder(c *OnionConnection, circ *Circuit) ActionableError
+
+	// Takes over the buffers of a command that has to wait for its turn
+	detach() streamCommand
+}
+
+// Where a stream command came from
+type streamOrigin struct {
+	circuitID CircuitID
+	route     *streamRoute
+	seq       uint64
+
+	// Its ID may belong to a new stream by the time we get here
+	stream *Stream
+}
+
+func (o *streamOrigin) CircID() CircuitID {
+	return o.circuitID
+}
+
+func (o *streamOrigin) origin() *streamOrigin {
+	return o
 }
 
 /* Stream cleanups
@@ -35,124 +103,369 @@ type Stream struct {
  * Finishing the goroutine means closing the socket and informing the channel that we're done (which should then dealloc us)
  */
 
-func NewStream(id StreamID) (*Stream, error) {
+func NewStream(id StreamID, flowControl bool) (*Stream, error) {
+	window := STREAMWINDOW_START
+	if flowControl {
+		window = math.MaxInt32
+	}
+
 	s := &Stream{
 		id:             id,
 		writeChan:      make(chan []byte, 505),
-		forwardWindow:  NewWindow(500),
-		backwardWindow: NewWindow(500),
+		forwardWindow:  NewWindow(window),
+		backwardWindow: NewWindow(window),
+		flowControl:    flowControl,
 	}
 	return s, nil
 }
 
+func (s *Stream) SetRoute(circID CircuitID, queue CircReadQueue, leg *confluxLeg) {
+	s.route.Store(&streamRoute{circID, queue, leg})
+}
+
+func (s *Stream) send(cmd streamCommand) {
+	route := s.route.Load().(*streamRoute)
+	s.sentSeq++
+	*cmd.origin() = streamOrigin{
+		circuitID: route.circID,
+		route:     route,
+		seq:       s.sentSeq,
+		stream:    s,
+	}
+	route.queue <- cmd
+}
+
+// Handles the stream's commands in the order it sent them. Commands that were on their way to a conflux leg that
+// handed the stream to another leg arrive late, and whatever the stream sent in the meantime has to wait for them.
+func (c *OnionConnection) handleStreamCommand(circ *Circuit, cmd streamCommand) ActionableError {
+	o := cmd.origin()
+	s := o.stream
+	if circ.streams[s.id] != s {
+		leg := circ.conflux
+		if s.route.Load().(*streamRoute) != o.route {
+			forwardStreamCommand(cmd.detach())
+		} else if leg != nil && leg == o.route.leg && !leg.ownsStreams {
+			// We are the new home leg, and the streams haven't reached us yet
+			return c.confluxHold(circ, cmd.detach())
+		}
+		return nil // The stream is gone
+	}
+
+	if o.seq != s.handledSeq+1 {
+		if s.early == nil {
+			s.early = make(map[uint64]streamCommand)
+		}
+		s.early[o.seq] = cmd.detach()
+		return nil
+	}
+
+	s.handledSeq++
+	err := cmd.handleInOrder(c, circ)
+	for err == nil {
+		next, ok := s.early[s.handledSeq+1]
+		if !ok {
+			break
+		}
+		delete(s.early, s.handledSeq+1)
+		s.handledSeq++
+		err = next.handleInOrder(c, circ)
+		next.ReleaseBuffers()
+	}
+	return err
+}
+
+// Passes on a command whose circuit handed its stream to another conflux leg
+func forwardStreamCommand(cmd streamCommand) {
+	o := cmd.origin()
+	route := o.stream.route.Load().(*streamRoute)
+	if route == o.route || route.leg == nil {
+		cmd.ReleaseBuffers()
+		return
+	}
+
+	o.circuitID = route.circID
+	o.route = route
+	if route.leg.set.handOver(route.queue, cmd) != nil {
+		cmd.ReleaseBuffers()
+	}
+}
+
 func (s *Stream) Destroy() {
 	close(s.writeChan)
 }
 
-var dialer = net.Dialer{
-	KeepAlive: 0,
-	DualStack: true,
-	Timeout:   5 * time.Second,
-}
+// Picks the address to connect to, based on the RELAY_BEGIN flags. Returns false if none is usable.
+func selectAddress(results []DNSAddress, flags uint32) (DNSAddress, bool) {
+	var v4, v6 *DNSAddress
+	for i := range results {
+		if results[i].Type == 4 && v4 == nil && flags&BEGIN_FLAG_IPV4_NOT_OK == 0 {
+			v4 = &results[i]
+		}
+		if results[i].Type == 6 && v6 == nil && flags&BEGIN_FLAG_IPV6_OK != 0 {
+			v6 = &results[i]
+		}
+	}
 
-func (s *Stream) Run(circID CircuitID, circWindow *Window, queue CircReadQueue, address string, port uint16, isDir bool, ep ExitPolicy) {
-	addr := ResolveDNS(address)[0]
+	if v6 != nil && (v4 == nil || flags&BEGIN_FLAG_IPV6_PREFERRED != 0) {
+		return *v6, true
+	}
+	if v4 != nil {
+		return *v4, true
+	}
+	return DNSAddress{}, false
+}
 
-	if !(addr.Type == 4 || addr.Type == 6) {
-		queue <- &StreamControl{
-			circuitID: circID,
+// Resolves and connects to the stream's target. On failure it tells the circuit why, and returns a nil conn.
+func (s *Stream) dial(address string, port uint16, flags uint32, config *Config) (net.Conn, *DNSAddress) {
+	results := ResolveDNS(address, flags&BEGIN_FLAG_IPV4_NOT_OK == 0, flags&BEGIN_FLAG_IPV6_OK != 0)
+	addr, ok := selectAddress(results, flags)
+	if !ok {
+		sc := &StreamControl{
 			streamID: s.id,
-			data: STREAM_DISCONNECTED,
-			reason: STREAM_REASON_RESOLVEFAILED,
+			data:     STREAM_DISCONNECTED,
+			reason:   STREAM_REASON_RESOLVEFAILED,
+		}
+		// We may have found addresses they didn't want
+		for i := range results {
+			if results[i].Type == 4 || results[i].Type == 6 {
+				sc.remote = &results[i]
+				break
+			}
 		}
+		s.send(sc)
+		return nil, nil
 	}
 
-	if !isDir && !ep.AllowsConnect(addr.Value, port) {
-		queue <- &StreamControl{
-			circuitID: circID,
+	if !config.ExitPolicy.AllowsConnect(addr.Value, port) {
+		s.send(&StreamControl{
 			streamID: s.id,
-			data: STREAM_DISCONNECTED,
-			reason: STREAM_REASON_EXITPOLICY,
-			remoteAddr: addr.Value,
-		}
-		return
+			data:     STREAM_DISCONNECTED,
+			reason:   STREAM_REASON_EXITPOLICY,
+			remote:   &addr,
+		})
+		return nil, nil
 	}
 
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", addr.String(), port))
+	dialer := net.Dialer{
+		Timeout:   config.StreamConnectTimeout,
+		LocalAddr: config.OutboundBindAddr(true, net.IP(addr.Value)),
+	}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(net.IP(addr.Value).String(), strconv.Itoa(int(port))))
 	if err != nil {
-		queue <- &StreamControl{
-			circuitID: circID,
-			streamID:  s.id,
-			data:      STREAM_DISCONNECTED,
-			reason:    STREAM_REASON_CONNECTREFUSED,
+		reason := STREAM_REASON_CONNECTREFUSED
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			reason = STREAM_REASON_TIMEOUT
 		}
-		return
+		s.send(&StreamControl{
+			streamID: s.id,
+			data:     STREAM_DISCONNECTED,
+			reason:   reason,
+		})
+		return nil, nil
+	}
+
+	return conn, &addr
+}
+
+// Runs the stream. Directory streams (BEGIN_DIR) have a dir handler, and are served in-process.
+func (s *Stream) Run(circWindow *Window, address string, port uint16, flags uint32, dir http.Handler, config *Config) {
+	defer s.releaseCounters()
+	defer s.dropWrites()
+
+	var conn net.Conn
+	var remote *DNSAddress
+	if dir != nil {
+		conn = serveDirectoryConn(dir)
+	} else {
+		conn, remote = s.dial(address, port, flags, config)
+		if conn == nil {
+			return
+		}
+	}
+
+	s.send(&StreamControl{
+		streamID: s.id,
+		data:     STREAM_CONNECTED,
+		remote:   remote,
+	})
+
+	readQueue := make(chan []byte, 5)
+	writeChan := s.writeChan
+	xoffSent := false
+	writeClosed := false
+	endReason := STREAM_REASON_DONE
+
+	// Exit port statistics, see exitstats.go. The bytes are added when the stream ends
+	countStats := dir == nil && config.ExitPortStatistics
+	var bytesRead, bytesWritten uint64
+	if countStats {
+		exitStats.NoteStreamOpened(port)
 	}
 
-	queue <- &StreamControl{
-		circuitID:  circID,
-		streamID:   s.id,
-		data:       STREAM_CONNECTED,
-		remoteAddr: addr.Value,
+	// Checks for idle streams, so that their sockets and goroutines don't stick around forever
+	idleTimeout := config.StreamIdleTimeout
+	lastActivity := time.Now()
+	var idleCheck <-chan time.Time
+	if idleTimeout != 0 {
+		ticker := time.NewTicker(idleTimeout / 4)
+		defer ticker.Stop()
+		idleCheck = ticker.C
 	}
 
+	// Once we sent RELAY_END the client doesn't have to answer, so don't wait for them forever
+	var lingerTimer *time.Timer
+	var lingerCheck <-chan time.Time
 	defer func() {
-		conn.Close()
+		if lingerTimer != nil {
+			lingerTimer.Stop()
+		}
+	}()
+
+	defer func() {
+		if writeClosed {
+			go lingerClose(conn)
+		} else {
+			conn.Close()
+		}
+
+		if countStats {
+			exitStats.NoteBytes(port, bytesRead, bytesWritten)
+		}
 
 		atomic.StoreInt32(&s.finished, 1)
 		s.backwardWindow.Abort()
 		s.forwardWindow.Abort()
 		circWindow.Abort()
 
-		queue <- &StreamControl{
-			circuitID: circID,
-			streamID:  s.id,
-			data:      STREAM_DISCONNECTED,
-			reason:    STREAM_REASON_DONE,
-		} // XXX this could deadlock
+		s.send(&StreamControl{
+			streamID: s.id,
+			data:     STREAM_DISCONNECTED,
+			reason:   endReason,
+		}) // XXX this could deadlock
 		Log(LOG_CIRC, "Disconnected stream %d to %s", s.id, address)
 	}()
 
-	readQueue := make(chan []byte, 5)
-
 	go s.reader(conn, circWindow, readQueue)
 
 	for {
 		select {
-		case data, ok := <-s.writeChan:
+		case data, ok := <-writeChan:
 			if !ok {
+				// The client is done sending. Pass that on, but let the other side finish what it's saying
+				if readQueue != nil {
+					if tcp, ok := conn.(*net.TCPConn); ok && tcp.CloseWrite() == nil {
+						writeClosed = true
+					}
+				}
 				return
 			}
-			_, err := conn.Write(data)
+			s.account.Remove()
+			lastActivity = time.Now()
+			if idleTimeout != 0 {
+				conn.SetWriteDeadline(lastActivity.Add(idleTimeout))
+			}
+			n, err := conn.Write(data)
+			bytesWritten += uint64(n)
 			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					endReason = STREAM_REASON_TIMEOUT
+				}
 				return
 			}
 			ReturnCellBuf(data)
 
-			for len(s.writeChan) < 10 && s.forwardWindow.GetLevel() <= 450 {
-				s.forwardWindow.Refill(50)
-				queue <- &StreamControl{
-					data:      STREAM_SENDME,
-					circuitID: circID,
-					streamID:  s.id,
+			if s.flowControl {
+				if !xoffSent && len(s.writeChan) >= STREAM_XOFF_CELLS {
+					xoffSent = true
+					s.send(&StreamControl{
+						data:     STREAM_XOFF,
+						streamID: s.id,
+					})
+				} else if xoffSent && len(s.writeChan) == 0 {
+					xoffSent = false
+					s.send(&StreamControl{
+						data:     STREAM_XON,
+						streamID: s.id,
+					})
 				}
+				continue
+			}
+
+			for len(s.writeChan) < 10 && s.forwardWindow.GetLevel() <= STREAMWINDOW_START-STREAMWINDOW_INCREMENT {
+				s.forwardWindow.Refill(STREAMWINDOW_INCREMENT)
+				s.send(&StreamControl{
+					data:     STREAM_SENDME,
+					streamID: s.id,
+				})
 			}
 		case data, ok := <-readQueue:
 			if !ok {
+				if s.readErr != io.EOF {
+					return
+				}
+
+				// They are done sending, but may still want to hear what the client has to say
+				readQueue = nil
+				s.send(&StreamControl{
+					streamID: s.id,
+					data:     STREAM_HALF_CLOSED,
+					reason:   STREAM_REASON_DONE,
+				})
+				lingerTimer = time.NewTimer(STREAM_LINGER_TIMEOUT)
+				lingerCheck = lingerTimer.C
+				continue
+			}
+			s.account.Add()
+			lastActivity = time.Now()
+			bytesRead += uint64(len(data))
+			s.send(&StreamData{
+				streamID: s.id,
+				data:     data,
+				account:  s.account,
+			}) // XXX this could deadlock
+		case now := <-idleCheck:
+			if now.Sub(lastActivity) > idleTimeout {
+				Log(LOG_CIRC, "Stream %d to %s timed out", s.id, address)
+				endReason = STREAM_REASON_TIMEOUT
 				return
 			}
-			queue <- &StreamData{
-				circuitID: circID,
-				streamID:  s.id,
-				data:      data,
-			} // XXX this could deadlock
+		case now := <-lingerCheck:
+			if quiet := now.Sub(lastActivity); quiet < STREAM_LINGER_TIMEOUT {
+				lingerTimer.Reset(STREAM_LINGER_TIMEOUT - quiet)
+				continue
+			}
+			Log(LOG_CIRC, "Closing half-closed stream %d to %s", s.id, address)
+			return
 		}
 	}
 }
 
-func (s *Stream) reader(conn net.Conn, circWindow *Window, queue chan []byte) {
-	var readBuf [4096]byte
+// Drops what the client sent that we won't get to write
+func (s *Stream) dropWrites() {
+	for {
+		select {
+		case data, ok := <-s.writeChan:
+			if !ok {
+				return
+			}
+			s.account.Remove()
+			ReturnCellBuf(data)
+		default:
+			return
+		}
+	}
+}
+
+// Closes a connection we already sent our FIN on, once the other side is done as well. Closing it while there's
+// unread data would reset the connection, and lose whatever we wrote that they didn't read yet.
+func lingerClose(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(STREAM_LINGER_TIMEOUT))
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+}
 
+// Reads at most one cell at a time, since each read takes one unit of both windows
+func (s *Stream) reader(conn net.Conn, circWindow *Window, queue chan []byte) {
 	for {
 		hasWnd1 := false
 		hasWnd2 := false
@@ -175,20 +488,23 @@ func (s *Stream) reader(conn net.Conn, circWindow *Window, queue chan []byte) {
 			}
 		}
 
-		bytes, err := conn.Read(readBuf[:])
+		cell := GetCellBuf(false)
+		bytes, err := conn.Read(cell[0:MAX_RELAY_LEN])
 		if err != nil && bytes <= 0 {
+			// We won't be sending anything, so let the other streams on the circuit have our spot
+			ReturnCellBuf(cell)
+			circWindow.Refill(1)
+			s.readErr = err
 			close(queue)
 			return
 		}
-		for i := 0; i < bytes;  {
-			s := MAX_RELAY_LEN
-			if s > bytes-i {
-				s = bytes-i
-			}
-			cell := GetCellBuf(false)
-			copy(cell, readBuf[i:])
-			queue <- cell[0:s] // XXX would it make sense to add a timeout here? This has proven to deadlock
-			i += s
+		if atomic.LoadInt32(&s.finished) != 0 {
+			// Nobody is listening anymore
+			ReturnCellBuf(cell)
+			circWindow.Refill(1)
+			close(queue)
+			return
 		}
+		queue <- cell[0:bytes] // XXX would it make sense to add a timeout here? This has proven to deadlock
 	}
 }
@@ -7,76 +7,106 @@ package main
 type StreamControl struct {
 	NeverForRelay
 	NoBuffers
-	circuitID  CircuitID
-	streamID   StreamID
-	data       StreamMessageType
-	reason     StreamEndReason
-	remoteAddr []byte
+	streamOrigin
+	streamID StreamID
+	data     StreamMessageType
+	reason   StreamEndReason
+	remote   *DNSAddress
 }
 
-func (sd *StreamControl) CircID() CircuitID {
-	return sd.circuitID
+func (sc *StreamControl) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	return c.handleStreamCommand(circ, sc)
 }
 
-func (sc *StreamControl) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+// The circuit is gone, but the stream may have moved on to another one
+func (sc *StreamControl) Undeliverable() {
+	forwardStreamCommand(sc)
+}
+
+func (sc *StreamControl) detach() streamCommand {
+	return sc
+}
+
+// The TTL we tell clients. Only two values, so that it doesn't reveal how long ago the name was looked up.
+func clipDNSTTL(ttl int) uint32 {
+	if ttl <= MIN_DNS_TTL {
+		return MIN_DNS_TTL
+	}
+	return MAX_DNS_TTL
+}
+
+// RELAY_CONNECTED: the address we connected to and its TTL
+func connectedPayload(addr *DNSAddress) []byte {
+	if addr == nil {
+		return nil
+	}
+
+	switch addr.Type {
+	case 4:
+		data := make([]byte, 4+4)
+		copy(data, addr.Value)
+		BigEndian.PutUint32(data[4:], clipDNSTTL(addr.TTL))
+		return data
+	case 6:
+		// Four zero bytes, so that it can't be confused with IPv4
+		data := make([]byte, 4+1+16+4)
+		data[4] = 6
+		copy(data[5:], addr.Value)
+		BigEndian.PutUint32(data[21:], clipDNSTTL(addr.TTL))
+		return data
+	}
+	return nil
+}
+
+// RELAY_END: the reason, followed by the address and its TTL when the reason is about the address
+func endPayload(reason StreamEndReason, addr *DNSAddress) []byte {
+	if addr == nil || (addr.Type != 4 && addr.Type != 6) || (reason != STREAM_REASON_EXITPOLICY && reason != STREAM_REASON_RESOLVEFAILED) {
+		return []byte{byte(reason)}
+	}
+
+	data := make([]byte, 1+len(addr.Value)+4)
+	data[0] = byte(reason)
+	copy(data[1:], addr.Value)
+	BigEndian.PutUint32(data[1+len(addr.Value):], clipDNSTTL(addr.TTL))
+	return data
+}
+
+// Only called for the stream's current circuit, see handleStreamCommand
+func (sc *StreamControl) handleInOrder(c *OnionConnection, circ *Circuit) ActionableError {
+	stream := sc.stream
 	switch sc.data {
 	case STREAM_CONNECTED:
-		var data []byte
-		if sc.remoteAddr != nil {
-			if len(sc.remoteAddr) == 4 {
-				data = make([]byte, 8) //XXX
-				copy(data, sc.remoteAddr)
-				data[6] = 1
-				data[7] = 44
-			} else if len(sc.remoteAddr) == 16 {
-				data = make([]byte, 25) //XXX
-				data[4] = 6
-				copy(data[5:], sc.remoteAddr)
-				data[23] = 1
-				data[24] = 44
-			}
-		}
-
-		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_CONNECTED, data)
+		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_CONNECTED, connectedPayload(sc.remote))
 
 	case STREAM_DISCONNECTED:
-		stream, ok := circ.streams[sc.streamID]
-		if !ok {
-			return nil
-		}
 		delete(circ.streams, sc.streamID)
 		stream.Destroy()
+		stream.dropWrites() // It stopped reading, but we may have given it more since
+		if stream.endSent {
+			return nil
+		}
 
 		// We need to inform the OP that the connection died
-		var data []byte
-		if sc.remoteAddr != nil {
-			if len(sc.remoteAddr) == 4 {
-				data = make([]byte, 9) //XXX
-				data[0] = byte(sc.reason)
-				copy(data[1:], sc.remoteAddr)
-				data[7] = 1
-				data[8] = 44
-			} else if len(sc.remoteAddr) == 16 {
-				data = make([]byte, 26) //XXX
-				data[0] = byte(sc.reason)
-				data[5] = 6
-				copy(data[6:], sc.remoteAddr)
-				data[24] = 1
-				data[25] = 44
-			} else {
-				data = []byte{byte(sc.reason)}
-			}
-		}
-		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_END, data)
+		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_END, endPayload(sc.reason, sc.remote))
 
-	case STREAM_SENDME:
-		_, ok := circ.streams[sc.streamID]
-		if !ok {
+	case STREAM_HALF_CLOSED:
+		// Tell the OP they won't get more data, but keep the stream around for what they still send
+		if stream.endSent {
 			return nil
 		}
+		stream.endSent = true
+		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_END, endPayload(sc.reason, nil))
 
+	case STREAM_SENDME:
 		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_SENDME, nil)
 
+	case STREAM_XOFF:
+		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_XOFF, []byte{0})
+
+	case STREAM_XON:
+		// Version 0, and a kbps_ewma of 0: no rate limit
+		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_XON, []byte{0, 0, 0, 0, 0})
+
 	default:
 		panic("Did not understand our StreamControl message!")
 	}
@@ -0,0 +1,65 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConnectedPayload(t *testing.T) {
+	v4 := &DNSAddress{Type: 4, TTL: 30, Value: []byte{192, 0, 2, 1}}
+	if p := connectedPayload(v4); !bytes.Equal(p, []byte{192, 0, 2, 1, 0, 0, 0x01, 0x2c}) {
+		t.Errorf("IPv4 CONNECTED is %x", p)
+	}
+
+	v6 := &DNSAddress{Type: 6, TTL: 86400, Value: bytes.Repeat([]byte{0xaa}, 16)}
+	expected := append([]byte{0, 0, 0, 0, 6}, v6.Value...)
+	expected = append(expected, 0, 0, 0x0e, 0x10)
+	if p := connectedPayload(v6); !bytes.Equal(p, expected) {
+		t.Errorf("IPv6 CONNECTED is %x", p)
+	}
+
+	if p := connectedPayload(nil); len(p) != 0 {
+		t.Errorf("CONNECTED without an address is %x", p)
+	}
+}
+
+func TestEndPayload(t *testing.T) {
+	v4 := &DNSAddress{Type: 4, TTL: 301, Value: []byte{192, 0, 2, 1}}
+	if p := endPayload(STREAM_REASON_EXITPOLICY, v4); !bytes.Equal(p, []byte{byte(STREAM_REASON_EXITPOLICY), 192, 0, 2, 1, 0, 0, 0x0e, 0x10}) {
+		t.Errorf("IPv4 END is %x", p)
+	}
+
+	v6 := &DNSAddress{Type: 6, TTL: 300, Value: bytes.Repeat([]byte{0xaa}, 16)}
+	expected := append([]byte{byte(STREAM_REASON_RESOLVEFAILED)}, v6.Value...)
+	expected = append(expected, 0, 0, 0x01, 0x2c)
+	if p := endPayload(STREAM_REASON_RESOLVEFAILED, v6); !bytes.Equal(p, expected) {
+		t.Errorf("IPv6 END is %x", p)
+	}
+
+	if p := endPayload(STREAM_REASON_DONE, v4); !bytes.Equal(p, []byte{byte(STREAM_REASON_DONE)}) {
+		t.Errorf("END for a closed stream is %x", p)
+	}
+	if p := endPayload(STREAM_REASON_EXITPOLICY, nil); !bytes.Equal(p, []byte{byte(STREAM_REASON_EXITPOLICY)}) {
+		t.Errorf("END without an address is %x", p)
+	}
+}
+
+func TestStreamControlReusedID(t *testing.T) {
+	old, _ := NewStream(1, false)
+	replacement, _ := NewStream(1, false)
+	circ := &Circuit{streams: map[StreamID]*Stream{1: replacement}}
+
+	old.SetRoute(1, nil, nil)
+	sc := &StreamControl{streamID: 1, data: STREAM_DISCONNECTED}
+	sc.streamOrigin = streamOrigin{circuitID: 1, route: old.route.Load().(*streamRoute), seq: 1, stream: old}
+	if err := sc.Handle(nil, circ); err != nil {
+		t.Fatal(err)
+	}
+	if circ.streams[1] != replacement {
+		t.Fatal("the old stream closed its replacement")
+	}
+}
@@ -6,16 +6,29 @@ package main
 
 type StreamData struct {
 	NeverForRelay
-	circuitID CircuitID
-	streamID  StreamID
-	data      []byte
+	streamOrigin
+	streamID StreamID
+	data     []byte
+	account  *QueueAccount
 }
 
-func (sd *StreamData) CircID() CircuitID {
-	return sd.circuitID
+func (sd *StreamData) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	return c.handleStreamCommand(circ, sd)
 }
 
-func (sd *StreamData) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+// The circuit is gone, but the stream may have moved on to another one
+func (sd *StreamData) Undeliverable() {
+	forwardStreamCommand(sd.detach())
+}
+
+func (sd *StreamData) detach() streamCommand {
+	held := *sd
+	sd.data = nil
+	sd.account = nil
+	return &held
+}
+
+func (sd *StreamData) handleInOrder(c *OnionConnection, circ *Circuit) ActionableError {
 	data := sd.data
 
 	for pos := 0; pos < len(data); pos += MAX_RELAY_LEN {
@@ -34,5 +47,6 @@ func (sd *StreamData) Handle(c *OnionConnection, circ *Circuit) ActionableError
 }
 
 func (sd *StreamData) ReleaseBuffers() {
+	sd.account.Remove()
 	ReturnCellBuf(sd.data)
 }
@@ -0,0 +1,73 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Every stream costs us two goroutines and, for exits, a socket. We limit how many a circuit, a connection and
+// the relay as a whole can have open.
+
+// After this many refusals a circuit is just wasting our time
+const CIRCUIT_MAX_STREAM_REFUSALS = 32
+
+// Reserves room for a new stream, or returns why there is none. The reservation is released by the stream when
+// it is done running.
+func (c *OnionConnection) admitStream(circ *Circuit, stream *Stream, isExit bool) ActionableError {
+	config := c.parentOR.config
+
+	if open := circ.openStreams(); config.MaxStreamsPerCircuit != 0 && open >= config.MaxStreamsPerCircuit {
+		// Only the circuit's own limit counts against it. The others are about everyone else's streams
+		circ.streamsRefused++
+		if circ.streamsRefused > CIRCUIT_MAX_STREAM_REFUSALS {
+			return CloseCircuit(fmt.Errorf("refused %d streams, circuit has %d", circ.streamsRefused, open), DESTROY_REASON_RESOURCELIMIT)
+		}
+		return RefuseStream(fmt.Errorf("circuit already has %d streams", open), STREAM_REASON_RESOURCELIMIT)
+	}
+
+	if !reserve(&c.openStreams, config.MaxStreamsPerConnection) {
+		return RefuseStream(errors.New("too many streams on this connection"), STREAM_REASON_RESOURCELIMIT)
+	}
+	if isExit && !reserve(&c.parentOR.openExitStreams, config.MaxExitSockets) {
+		atomic.AddInt32(&c.openStreams, -1)
+		return RefuseStream(errors.New("too many open exit sockets"), STREAM_REASON_RESOURCELIMIT)
+	}
+
+	stream.counters = append(stream.counters, &c.openStreams)
+	if isExit {
+		stream.counters = append(stream.counters, &c.parentOR.openExitStreams)
+	}
+	return nil
+}
+
+// The streams that still count against the circuit: not the ones we already sent END on, which are only waiting
+// for the client to finish
+func (circ *Circuit) openStreams() int {
+	open := 0
+	for _, stream := range circ.streams {
+		if !stream.endSent {
+			open++
+		}
+	}
+	return open
+}
+
+func reserve(counter *int32, limit int) bool {
+	if atomic.AddInt32(counter, 1) > int32(limit) && limit != 0 {
+		atomic.AddInt32(counter, -1)
+		return false
+	}
+	return true
+}
+
+func (s *Stream) releaseCounters() {
+	for _, counter := range s.counters {
+		atomic.AddInt32(counter, -1)
+	}
+	s.counters = nil
+}
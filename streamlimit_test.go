@@ -0,0 +1,68 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestStreamLimits(t *testing.T) {
+	c := &OnionConnection{parentOR: &ORCtx{config: &Config{
+		MaxStreamsPerCircuit:    2,
+		MaxStreamsPerConnection: 3,
+		MaxExitSockets:          1,
+	}}}
+	circ := &Circuit{streams: make(map[StreamID]*Stream)}
+	other := &Circuit{streams: make(map[StreamID]*Stream)}
+
+	exit := &Stream{}
+	if err := c.admitStream(circ, exit, true); err != nil {
+		t.Fatal(err)
+	}
+	circ.streams[1] = exit
+	if err := c.admitStream(circ, &Stream{}, true); err == nil || err.Handle() != ERROR_REFUSE_STREAM {
+		t.Fatalf("expected the exit socket limit, got %v", err)
+	}
+
+	dir := &Stream{}
+	if err := c.admitStream(circ, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	circ.streams[2] = dir
+	if err := c.admitStream(circ, &Stream{}, false); err == nil || err.Handle() != ERROR_REFUSE_STREAM {
+		t.Fatalf("expected the circuit limit, got %v", err)
+	}
+
+	if err := c.admitStream(other, &Stream{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.admitStream(other, &Stream{}, false); err == nil || err.Handle() != ERROR_REFUSE_STREAM {
+		t.Fatalf("expected the connection limit, got %v", err)
+	}
+
+	exit.releaseCounters()
+	if err := c.admitStream(other, &Stream{}, true); err != nil {
+		t.Fatalf("released stream still counted: %v", err)
+	}
+
+	for i := 0; i < CIRCUIT_MAX_STREAM_REFUSALS; i++ {
+		c.admitStream(circ, &Stream{}, false)
+	}
+	if err := c.admitStream(circ, &Stream{}, false); err == nil || err.Handle() != ERROR_CLOSE_CIRCUIT {
+		t.Fatalf("expected the circuit to be closed, got %v", err)
+	}
+
+	// Half-closed streams don't count against the circuit, and neither do refusals because of the other limits
+	full := &OnionConnection{parentOR: &ORCtx{config: &Config{MaxStreamsPerCircuit: 1, MaxExitSockets: 1}}}
+	busy := &Circuit{streams: map[StreamID]*Stream{1: {endSent: true}}}
+	if err := full.admitStream(busy, &Stream{}, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= CIRCUIT_MAX_STREAM_REFUSALS; i++ {
+		if err := full.admitStream(busy, &Stream{}, true); err == nil || err.Handle() != ERROR_REFUSE_STREAM {
+			t.Fatalf("expected the exit socket limit, got %v", err)
+		}
+	}
+}
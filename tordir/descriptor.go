@@ -47,6 +47,8 @@ type Descriptor struct {
 	GeoIPDBDigest                                   string
 	GeoIP6DBDigest                                  string
 	ExitPolicy                                      string
+	ExitStats                                       string // exit-stats-end and friends, for the extra-info
+	Protocols                                       string // The subprotocol versions for the proto line
 }
 
 func (d *Descriptor) Validate() error {
@@ -68,9 +70,6 @@ func (d *Descriptor) Validate() error {
 	if d.UptimeStart.IsZero() {
 		return errors.New("no UptimeStart given")
 	}
-	if d.OnionKey == nil {
-		return errors.New("No OnionKey given")
-	}
 	if d.NTORKey == nil {
 		return errors.New("no NTORKey given")
 	}
@@ -78,9 +77,18 @@ func (d *Descriptor) Validate() error {
 }
 
 func (d *Descriptor) SignedDescriptor() (string, error) {
+	desc, extra, err := d.SignedDocuments()
+	if err != nil {
+		return "", err
+	}
+	return desc + extra, nil
+}
+
+// Returns the signed server descriptor and the extra-info document that goes with it
+func (d *Descriptor) SignedDocuments() (string, string, error) {
 	var buf, extra bytes.Buffer
 	if err := d.Validate(); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	published := time.Now()
@@ -95,30 +103,37 @@ func (d *Descriptor) SignedDescriptor() (string, error) {
 	buf.WriteString(fmt.Sprintf("router %s %s %d 0 %d\n", d.Nickname, d.Address, d.ORPort, d.DirPort))
 	extra.WriteString(fmt.Sprintf("extra-info %s %X\n", d.Nickname, fingerprint))
 	extra.WriteString(fmt.Sprintf("published %s\n", published.Format("2006-01-02 15:04:05")))
+	extra.WriteString(d.ExitStats)
+	extra.WriteString("router-signature\n")
 
 	for _, addr := range d.ORAddress {
 		buf.WriteString(addr)
 	}
 	buf.WriteString(fmt.Sprintf("platform %s\n", d.Platform))
-	buf.WriteString(fmt.Sprintf("protocols Link 1 2 Circuit 1\n")) // Is this really needed?
+	if d.Protocols != "" {
+		buf.WriteString(fmt.Sprintf("proto %s\n", d.Protocols))
+	}
 	buf.WriteString(fmt.Sprintf("published %s\n", published.Format("2006-01-02 15:04:05")))
 	buf.WriteString(fmt.Sprintf("fingerprint %s\n", fp))
 	buf.WriteString(fmt.Sprintf("uptime %d\n", published.Unix()-d.UptimeStart.Unix()+1))
 	buf.WriteString(fmt.Sprintf("bandwidth %d %d %d\n", d.BandwidthAvg, d.BandwidthBurst, d.BandwidthObserved))
 	extraDigest := sha1.Sum(extra.Bytes())
 	buf.WriteString(fmt.Sprintf("extra-info-digest %X\n", extraDigest[:]))
-	buf.WriteString(fmt.Sprintf("onion-key\n"))
-	onion, err := d.OnionKey.MarshalPKCS1PublicKeyPEM()
-	if err != nil {
-		return "", err
+	if d.OnionKey != nil {
+		// Relays that refuse TAP don't have one
+		buf.WriteString(fmt.Sprintf("onion-key\n"))
+		onion, err := d.OnionKey.MarshalPKCS1PublicKeyPEM()
+		if err != nil {
+			return "", "", err
+		}
+		buf.Write(onion)
 	}
-	buf.Write(onion)
 
 	buf.WriteString(fmt.Sprintf("signing-key\n"))
 
 	pub, err := d.SigningKey.MarshalPKCS1PublicKeyPEM()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	buf.Write(pub)
 
@@ -139,6 +154,9 @@ func (d *Descriptor) SignedDescriptor() (string, error) {
 	}
 	buf.WriteString(fmt.Sprintf("ntor-onion-key %s\n", base64.StdEncoding.EncodeToString(d.NTORKey)))
 	buf.WriteString(d.ExitPolicy)
+	if d.IPv6Policy != "" && d.IPv6Policy != "reject 1-65535" {
+		buf.WriteString(fmt.Sprintf("ipv6-policy %s\n", d.IPv6Policy))
+	}
 	buf.WriteString(fmt.Sprintf("router-signature\n"))
 
 	digest := sha1.Sum(buf.Bytes())
@@ -146,24 +164,24 @@ func (d *Descriptor) SignedDescriptor() (string, error) {
 	// Sign descriptor
 	signature, err := d.SigningKey.PrivateEncrypt(digest[:])
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	pem.Encode(&buf, &pem.Block{
 		Type:  "SIGNATURE",
 		Bytes: signature,
 	})
 
-	// Sign extrainfo
-	signature, err = d.SigningKey.PrivateEncrypt(digest[:])
+	// Sign extrainfo, which has a digest of its own
+	signature, err = d.SigningKey.PrivateEncrypt(extraDigest[:])
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	pem.Encode(&extra, &pem.Block{
 		Type:  "SIGNATURE",
 		Bytes: signature,
 	})
 
-	return buf.String() + extra.String(), nil
+	return buf.String(), extra.String(), nil
 }
 
 func (d *Descriptor) Publish(address string) error {
@@ -11,6 +11,7 @@ import (
 type Window struct {
 	cond   *sync.Cond
 	window int
+	paused bool
 }
 
 func NewWindow(window int) *Window {
@@ -31,13 +32,27 @@ func (w *Window) Refill(count int) {
 	w.cond.L.Unlock()
 }
 
+// Stops Take from handing out anything until Resume is called, regardless of the window
+func (w *Window) Pause() {
+	w.cond.L.Lock()
+	w.paused = true
+	w.cond.L.Unlock()
+}
+
+func (w *Window) Resume() {
+	w.cond.L.Lock()
+	w.paused = false
+	w.cond.Broadcast()
+	w.cond.L.Unlock()
+}
+
 func (w *Window) Take() bool {
 	w.cond.L.Lock()
-	if w.window <= 0 {
+	if w.window <= 0 || w.paused {
 		w.cond.Wait()
 	}
 	st := false
-	if w.window > 0 {
+	if w.window > 0 && !w.paused {
 		st = true
 		w.window--
 	}
@@ -47,7 +62,7 @@ func (w *Window) Take() bool {
 
 func (w *Window) TryTake() bool {
 	w.cond.L.Lock()
-	if w.window > 0 {
+	if w.window > 0 && !w.paused {
 		w.window--
 		w.cond.L.Unlock()
 		return true